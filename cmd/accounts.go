@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// AccountEntry.Permissions
+const (
+	PERM_CREATE = "create" // Create new files, directories and symlinks
+	PERM_UPDATE = "update" // Replace existing files and symlinks, and change metadata and permissions
+	PERM_DELETE = "delete" // Delete files, directories and symlinks
+	PERM_READ   = "read"   // Compare the contents of the folder, as needed for mirroring
+)
+
+var ALL_PERMISSIONS = []string{PERM_CREATE, PERM_UPDATE, PERM_DELETE, PERM_READ}
+
+// Account is a credential accepted by the server, along with what it may do
+type Account struct {
+	AccountEntry
+
+	encKey [KEY_SIZE]byte
+	macKey [KEY_SIZE]byte
+}
+
+// Check if the account may access a folder
+func (a *Account) HasFolder(folderID string) bool {
+	if len(a.Folders) == 0 {
+		return true
+	}
+
+	for _, f := range a.Folders {
+		if f == folderID {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the account has a permission
+func (a *Account) Can(perm string) bool {
+	for _, p := range a.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a path relative to the folder root is within the paths of the account
+func (a *Account) HasPath(localPath string) bool {
+	if len(a.Paths) == 0 {
+		return true
+	}
+
+	for _, p := range a.Paths {
+		if localPath == p || strings.HasPrefix(localPath, p+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the path of the account that contains a path relative to the folder root, or "" if the account has no paths
+func (a *Account) PathOf(localPath string) string {
+	for _, p := range a.Paths {
+		if localPath == p || strings.HasPrefix(localPath, p+string(os.PathSeparator)) {
+			return p
+		}
+	}
+	return ""
+}
+
+// Check if a path relative to the folder root is within, or leads to, the paths of the account
+// Sessions may be confined to any such path, as requests within it are still checked individually
+func (a *Account) HasPrefix(prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, string(os.PathSeparator))
+	if prefix == "" || a.HasPath(prefix) {
+		return true
+	}
+
+	for _, p := range a.Paths {
+		if strings.HasPrefix(p, prefix+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate an account entry, cleaning its paths
+func validateAccount(entry *AccountEntry, folders map[string]*FolderEntry) error {
+	if entry.Name == "" {
+		return errors.New("Missing name")
+	} else if name, err := cleanRelPath(entry.Name); err != nil || name != entry.Name || strings.ContainsRune(name, os.PathSeparator) || name == "." || isInternalPath(name) {
+		return fmt.Errorf("Name %s cannot be used as a directory name", entry.Name) // Names are used as directories of tenant folders
+	} else if entry.Password == "" {
+		return errors.New("Missing password")
+	}
+
+	for _, f := range entry.Folders {
+		if _, ok := folders[f]; !ok {
+			return fmt.Errorf("Unknown folder %s", f)
+		}
+	}
+
+	if len(entry.Permissions) == 0 {
+		return errors.New("No permissions")
+	}
+
+	for _, perm := range entry.Permissions {
+		switch perm {
+		case PERM_CREATE, PERM_UPDATE, PERM_DELETE, PERM_READ:
+		default:
+			return fmt.Errorf("Invalid permission %s", perm)
+		}
+	}
+
+	for i, p := range entry.Paths {
+		cleaned, err := cleanRelPath(p)
+		if err != nil {
+			return err
+		} else if cleaned == "." {
+			return fmt.Errorf("Path %s is the folder root, leave out paths to allow the whole folder", p)
+		}
+		entry.Paths[i] = cleaned
+	}
+
+	// Without paths, the usage of the account could only be told apart from others' in tenant folders
+	if entry.Quota > 0 && len(entry.Paths) == 0 {
+		account := Account{AccountEntry: *entry}
+		for id, folder := range folders {
+			if !folder.Tenants && account.HasFolder(id) {
+				return fmt.Errorf("Quota without paths in folder %s, which has no tenants", id)
+			}
+		}
+	}
+
+	return nil
+}
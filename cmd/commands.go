@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Load a single folder from a configuration file
+func loadFolder(configPath string, folderID string) (*FolderEntry, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config.Folders {
+		folder := &config.Folders[i]
+		if folder.ID == folderID {
+			folder.Path = strings.TrimSuffix(folder.Path, string(os.PathSeparator)) + string(os.PathSeparator)
+			return folder, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown folder %s", folderID)
+}
+
+// versions list <config> <folder> [path]
+// versions restore <config> <folder> <path> <version>
+func runVersions(args []string) error {
+	if len(args) < 3 {
+		return errors.New("Missing arguments")
+	}
+
+	folder, err := loadFolder(args[1], args[2])
+	if err != nil {
+		return err
+	}
+
+	// Versions can be listed and restored even if versioning has since been disabled
+	versioner := NewVersioner(folder.Path, folder.Versioning)
+	if versioner == nil {
+		versioner = &Versioner{
+			Root: folder.Path,
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		relPath := ""
+		if len(args) > 3 {
+			if relPath, err = cleanRelPath(args[3]); err != nil {
+				return err
+			} else if relPath == "." {
+				relPath = ""
+			}
+		}
+
+		versions, err := versioner.List(relPath)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			fmt.Printf("%s\t%s\n", version.Time.Format(VERSION_TIME_FORMAT), version.RelPath)
+		}
+		return nil
+	case "restore":
+		if len(args) != 5 {
+			return errors.New("Missing arguments")
+		}
+
+		relPath, err := cleanRelPath(args[3])
+		if err != nil {
+			return err
+		}
+
+		if err = versioner.Restore(relPath, args[4]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Restored version %s of %s\n", args[4], relPath)
+		return nil
+	default:
+		return fmt.Errorf("Unknown command versions %s", args[0])
+	}
+}
+
+// init <config> <folder>
+func runInit(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Missing arguments")
+	}
+
+	folder, err := loadFolder(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	if err = CreateMarker(folder.Path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created folder marker in %s\n", folder.Path)
+	return nil
+}
+
+// confirm-deletes <config> <folder>
+func runConfirmDeletes(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Missing arguments")
+	}
+
+	folder, err := loadFolder(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	if err = ConfirmDeletes(folder.Path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Confirmed held back deletes in %s\n", folder.Path)
+	return nil
+}
+
+// status <config> <folder>
+func runStatus(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Missing arguments")
+	}
+
+	folder, err := loadFolder(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	queues, err := LoadQueueStatus(folder.Path)
+	if err != nil {
+		return err
+	}
+
+	if len(queues) == 0 {
+		fmt.Printf("No queued changes in %s\n", folder.Path)
+		return nil
+	}
+
+	for _, q := range queues {
+		if q.Resync {
+			fmt.Printf("%s\t%d queued, full synchronization pending\n", q.Peer, q.Depth)
+		} else {
+			fmt.Printf("%s\t%d queued\n", q.Peer, q.Depth)
+		}
+	}
+	return nil
+}
+
+// revert <config> <folder>
+func runRevert(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Missing arguments")
+	}
+
+	folder, err := loadFolder(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	if folder.Mode != MODE_RECEIVE_ONLY {
+		return fmt.Errorf("Folder %s is not receive-only", folder.ID)
+	}
+
+	symlinks := folder.Symlinks
+	if symlinks == "" {
+		symlinks = SYMLINKS_PRESERVE
+	}
+
+	versioner := NewVersioner(folder.Path, folder.Versioning)
+	if err = RevertLocalChanges(folder.Path, ignoreMatcher(folder.Path), symlinks, versioner); err != nil {
+		return err
+	}
+
+	// Peers would otherwise only send what changed since they last synchronized
+	if err = ResetAcks(folder.Path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Reverted local changes in %s, peers will send their versions on the next synchronization\n", folder.Path)
+	return nil
+}
@@ -97,6 +97,37 @@ func (c *EncryptedConnection) ReadEncryptedFull() ([]byte, error) {
 	return b.Bytes(), err
 }
 
+// The source of a stream ended early or could not be read
+// The stream was padded to its announced length, so the connection is still usable but the data is not
+type sourceError struct {
+	error
+}
+
+// Records the error of a reader, to tell it apart from errors writing to the connection
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// Write exactly l bytes from source
+// If source has more, the rest is not sent; if it has less or fails, the stream is padded and a sourceError is returned
 func (c *EncryptedConnection) WriteEncryptedStream(source io.Reader, l uint64) error {
 	encStream, err := NewEncryptStream(c.encKey, c)
 	if err != nil {
@@ -113,15 +144,33 @@ func (c *EncryptedConnection) WriteEncryptedStream(source io.Reader, l uint64) e
 		return err
 	}
 
-	tee := io.TeeReader(source, mac)
-
-	if _, err = io.Copy(encStream, tee); err != nil {
+	src := &errReader{r: io.LimitReader(source, int64(l))}
+	n, err := io.Copy(encStream, io.TeeReader(src, mac))
+	if err != nil && src.err == nil {
 		return err
 	}
 
+	// Keep the framing intact when the source is short
+	srcErr := src.err
+	if n < int64(l) {
+		if srcErr == nil {
+			srcErr = io.ErrUnexpectedEOF
+		}
+
+		if _, err = io.CopyN(encStream, io.TeeReader(zeroReader{}, mac), int64(l)-n); err != nil {
+			return err
+		}
+	}
+
 	macSum := mac.Sum(nil)
-	_, err = c.Write(macSum)
-	return err
+	if _, err = c.Write(macSum); err != nil {
+		return err
+	}
+
+	if srcErr != nil {
+		return sourceError{srcErr}
+	}
+	return nil
 }
 
 func (c *EncryptedConnection) ReadEncryptedStream(target io.Writer) error {
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How a folder is watched for changes
+const (
+	WATCHER_AUTO   = "auto"   // Notifications where the filesystem supports them, polling otherwise
+	WATCHER_NOTIFY = "notify" // Notifications from the operating system
+	WATCHER_POLL   = "poll"   // Periodically listing every directory
+)
+
+// EventSource delivers changes within the directories added to it, like fsnotify
+type EventSource interface {
+	Add(name string) error
+	Remove(name string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// Notifications from the operating system
+type notifySource struct {
+	watcher *fsnotify.Watcher
+}
+
+func newNotifySource() (*notifySource, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &notifySource{watcher: watcher}, nil
+}
+
+func (n *notifySource) Add(name string) error {
+	return n.watcher.Add(name)
+}
+
+func (n *notifySource) Remove(name string) error {
+	return n.watcher.Remove(name)
+}
+
+func (n *notifySource) Events() <-chan fsnotify.Event {
+	return n.watcher.Events
+}
+
+func (n *notifySource) Errors() <-chan error {
+	return n.watcher.Errors
+}
+
+func (n *notifySource) Close() error {
+	return n.watcher.Close()
+}
+
+// State of a directory entry, compared between polls
+type pollEntry struct {
+	ModTime time.Time
+	Size    int64
+	Mode    os.FileMode
+}
+
+// pollSource finds changes by listing every added directory periodically
+// It works on any filesystem, including network and FUSE mounts that do not send notifications
+type pollSource struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+
+	mu   sync.Mutex
+	dirs map[string]map[string]pollEntry
+}
+
+func newPollSource(interval time.Duration) *pollSource {
+	p := &pollSource{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		dirs:     make(map[string]map[string]pollEntry),
+	}
+	go p.run()
+	return p
+}
+
+// Start polling a directory, without reporting what it already contains
+func (p *pollSource) Add(name string) error {
+	entries, err := listPollEntries(name)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dirs[filepath.Clean(name)] = entries
+	return nil
+}
+
+func (p *pollSource) Remove(name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dirs, filepath.Clean(name))
+	return nil
+}
+
+func (p *pollSource) Events() <-chan fsnotify.Event {
+	return p.events
+}
+
+func (p *pollSource) Errors() <-chan error {
+	return p.errors
+}
+
+func (p *pollSource) Close() error {
+	close(p.done)
+	return nil
+}
+
+func (p *pollSource) run() {
+	defer close(p.events)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		dirs := make([]string, 0, len(p.dirs))
+		for dir := range p.dirs {
+			dirs = append(dirs, dir)
+		}
+		p.mu.Unlock()
+
+		for _, dir := range dirs {
+			// Events are sent without the lock, as the receiver adds and removes directories
+			for _, e := range p.poll(dir) {
+				select {
+				case p.events <- e:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Compare a directory to its last listing
+func (p *pollSource) poll(dir string) []fsnotify.Event {
+	entries, err := listPollEntries(dir)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, ok := p.dirs[dir]
+	if !ok {
+		return nil // Removed in the meantime
+	} else if err != nil {
+		// The directory itself is gone, which its parent reports
+		if os.IsNotExist(err) {
+			delete(p.dirs, dir)
+		}
+		return nil
+	}
+	p.dirs[dir] = entries
+
+	events := []fsnotify.Event{}
+	for name, entry := range entries {
+		path := filepath.Join(dir, name)
+		before, existed := old[name]
+		if !existed {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		} else if entry.Mode&os.ModeType != before.Mode&os.ModeType {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Create})
+		} else if entry.Mode != before.Mode {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+		} else if !entry.Mode.IsDir() && (entry.Size != before.Size || !entry.ModTime.Equal(before.ModTime)) {
+			events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Write})
+		}
+	}
+
+	for name := range old {
+		if _, ok := entries[name]; !ok {
+			events = append(events, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
+
+func listPollEntries(dir string) (map[string]pollEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]pollEntry, len(files))
+	for _, fi := range files {
+		entries[fi.Name()] = pollEntry{
+			ModTime: fi.ModTime(),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// Create a FIFO
+func Mkfifo(path string, mode uint32) error {
+	return syscall.Mkfifo(path, mode)
+}
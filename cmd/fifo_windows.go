@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "errors"
+
+// Create a FIFO
+// Windows has no FIFOs within the filesystem
+func Mkfifo(path string, mode uint32) error {
+	return errors.New("FIFOs are not supported on Windows")
+}
@@ -1,41 +1,399 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-func ListItems(root string, relPath string) ([]string, []string, error) {
+// Symlink policies
+const (
+	SYMLINKS_PRESERVE = "preserve" // Symlinks are sent as links
+	SYMLINKS_FOLLOW   = "follow"   // Symlinks are treated as the file or directory they point to
+	SYMLINKS_SKIP     = "skip"     // Symlinks are never sent
+)
+
+// Special file policies
+const (
+	SPECIALS_SKIP     = "skip"     // FIFOs, sockets and devices are never sent
+	SPECIALS_METADATA = "metadata" // FIFOs are recreated on the peer, sockets and devices are never sent
+)
+
+// Names starting with this prefix are used internally and are never synchronized
+const INTERNAL_PREFIX = ".simplesync"
+
+// Default staging directory within each folder
+const STAGING_DIR = INTERNAL_PREFIX + ".tmp"
+
+// Mode bits that are replicated
+const MODE_MASK = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// Mode bits that are only applied if the folder allows it, as they let anyone able to write files run them as their owner
+const MODE_SETID = os.ModeSetuid | os.ModeSetgid
+
+type ScanResult struct {
+	Files    []string
+	Dirs     []string
+	Links    []string
+	Specials []string // FIFOs, sockets and devices
+}
+
+// List files, directories and symlinks beneath root recursively, skipping ignored paths
+func ListItems(root string, relPath string, ignore *IgnoreMatcher, symlinks string) (*ScanResult, error) {
+	result := &ScanResult{
+		Files:    []string{},
+		Dirs:     []string{},
+		Links:    []string{},
+		Specials: []string{},
+	}
+
+	if err := listItems(root, relPath, ignore, symlinks, nil, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func listItems(root string, relPath string, ignore *IgnoreMatcher, symlinks string, ancestors []string, result *ScanResult) error {
+	// Followed symlinks may point back to a directory that is already being walked
+	if symlinks == SYMLINKS_FOLLOW {
+		realPath, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range ancestors {
+			if a == realPath {
+				log.Printf("Not following symlink loop at %s", root)
+				return nil
+			}
+		}
+		ancestors = append(ancestors, realPath)
+	}
+
 	var dirs []os.FileInfo
 	files, err := ioutil.ReadDir(root)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	fileList := []string{}
-	dirList := []string{}
-
 	for _, f := range files {
+		if f.Mode()&os.ModeSymlink != 0 {
+			switch symlinks {
+			case SYMLINKS_SKIP:
+				continue
+			case SYMLINKS_FOLLOW:
+				target, err := os.Stat(root + f.Name())
+				if err != nil {
+					log.Printf("Not following broken symlink %s: %s", root+f.Name(), err)
+					continue
+				}
+				f = target
+			default:
+				if !ignore.Ignored(relPath+f.Name(), false) {
+					result.Links = append(result.Links, relPath+f.Name())
+				}
+				continue
+			}
+		}
+
+		if ignore.Ignored(relPath+f.Name(), f.IsDir()) {
+			continue
+		}
+
 		if f.IsDir() {
-			dirList = append(dirList, relPath+f.Name())
+			result.Dirs = append(result.Dirs, relPath+f.Name())
 			dirs = append(dirs, f)
 			continue
 		}
 
+		// Special files must never be opened, reading a FIFO blocks until something writes to it
+		if IsSpecial(f) {
+			result.Specials = append(result.Specials, relPath+f.Name())
+			continue
+		}
+
 		// Is file
-		fileList = append(fileList, relPath+f.Name())
+		result.Files = append(result.Files, relPath+f.Name())
 	}
 
 	// Walk directories
 	for _, d := range dirs {
-		recursiveFileList, recursiveDirList, err := ListItems(root+d.Name()+string(os.PathSeparator), relPath+d.Name()+string(os.PathSeparator))
+		err := listItems(root+d.Name()+string(os.PathSeparator), relPath+d.Name()+string(os.PathSeparator), ignore, symlinks, ancestors, result)
 		if err != nil {
-			return nil, nil, err
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Whether a file is a FIFO, socket or device rather than a regular file, directory or symlink
+func IsSpecial(fi os.FileInfo) bool {
+	return fi.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// Remove a path recursively, keeping ignored paths beneath it along with the directories containing them
+// Removed files are moved into the versions directory if a versioner is given
+func RemoveUnignored(root string, relPath string, ignore *IgnoreMatcher, versioner *Versioner) error {
+	fqpath := root + relPath
+	fi, err := os.Lstat(fqpath)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if ignore.Ignored(relPath, fi.IsDir()) {
+		return nil
+	}
+
+	if !fi.IsDir() {
+		if versioner != nil {
+			return versioner.Move(relPath)
+		}
+		return os.Remove(fqpath)
+	}
+
+	entries, err := ioutil.ReadDir(fqpath)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err = RemoveUnignored(root, relPath+string(os.PathSeparator)+e.Name(), ignore, versioner); err != nil {
+			return err
+		}
+	}
+
+	// Only remove the directory if nothing was kept
+	entries, err = ioutil.ReadDir(fqpath)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		return nil
+	}
+
+	return os.Remove(fqpath)
+}
+
+// Clean a relative path, rejecting paths that are absolute or escape their root
+func cleanRelPath(relPath string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(relPath))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Path %s escapes root", relPath)
+	}
+	return cleaned, nil
+}
+
+// Check if a relative path matches a pattern
+// The pattern matches if it matches the path itself or any of its parent directories, so "docs/" or "docs" match everything beneath docs
+func matchPathPattern(pattern string, relPath string) bool {
+	pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+	p := filepath.ToSlash(relPath)
+	for p != "." && p != "/" && p != "" {
+		if ok, _ := filepath.Match(pattern, p); ok {
+			return true
+		}
+		p = filepath.ToSlash(filepath.Dir(p))
+	}
+	return false
+}
+
+// Check if any directory between root and a relative path is a symlink
+func hasSymlinkParent(root string, relPath string) (bool, error) {
+	dir := filepath.Dir(relPath)
+	for dir != "." && dir != string(os.PathSeparator) {
+		fi, err := os.Lstat(root + dir)
+		if err != nil && os.IsNotExist(err) {
+			// Missing directories will be created as real directories
+		} else if err != nil {
+			return false, err
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+	return false, nil
+}
+
+// Check if a symlink target leads outside of root when followed from the directory containing the link
+func symlinkEscapes(root string, linkDir string, target string) (bool, error) {
+	realRoot, err := evalExisting(root)
+	if err != nil {
+		return false, err
+	}
+
+	dir, ok, err := resolveSymlinkTarget(linkDir, target)
+	if err != nil || !ok {
+		return !ok, err
+	}
+
+	return !isWithin(dir, realRoot), nil
+}
+
+// Get where a symlink target leads when followed from the directory containing the link
+// The target is resolved against the filesystem, so symlinks it passes through are followed
+// Returns false for ".." after other components, as a symlink created there later could change where it leads
+func resolveSymlinkTarget(linkDir string, target string) (string, bool, error) {
+	dir, err := evalExisting(linkDir)
+	if err != nil {
+		return "", false, err
+	}
+
+	named := false
+	for _, component := range strings.Split(filepath.ToSlash(target), "/") {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if named {
+				return "", false, nil
+			}
+			dir = filepath.Dir(dir)
+		default:
+			named = true
+			dir = filepath.Join(dir, component)
+			if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if dir, err = filepath.EvalSymlinks(dir); err != nil {
+					return "", false, err
+				}
+			}
+		}
+	}
+
+	return dir, true, nil
+}
+
+// Check if a path is a directory or beneath it
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// Resolve the symlinks of the existing part of a path, keeping the parts that do not exist yet
+func evalExisting(path string) (string, error) {
+	path = filepath.Clean(path)
+	realPath, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return realPath, nil
+	} else if !os.IsNotExist(err) || filepath.Dir(path) == path {
+		return "", err
+	}
+
+	parent, err := evalExisting(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(path)), nil
+}
+
+// Check if a relative path is, or is beneath, a path used internally
+func isInternalPath(relPath string) bool {
+	for _, component := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if strings.HasPrefix(component, INTERNAL_PREFIX) {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a new file in a directory to receive data into before it is renamed into place
+// Unlike ioutil.TempFile, the file is created with the default permissions
+func CreateStagingFile(dir string) (*os.File, error) {
+	for {
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, fmt.Sprintf("%s-%s.tmp", INTERNAL_PREFIX, hex.EncodeToString(suffix)))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
 		}
+		return f, err
+	}
+}
+
+// Flush a directory so that renames within it are persisted
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Check that a staging directory is not the folder itself, and that it is never synchronized if it is within the folder
+func CheckStagingDir(stagingDir string, root string) error {
+	absStaging, err := filepath.Abs(stagingDir)
+	if err != nil {
+		return err
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	relPath, err := filepath.Rel(absRoot, absStaging)
+	if err != nil {
+		return nil // Different volume
+	}
+
+	if relPath == "." {
+		return errors.New("Staging directory must not be the folder itself")
+	} else if relPath != ".." && !strings.HasPrefix(relPath, ".."+string(os.PathSeparator)) && !isInternalPath(relPath) {
+		return fmt.Errorf("Staging directory within the folder must start with %s", INTERNAL_PREFIX)
+	}
+	return nil
+}
+
+// Create a staging directory and remove stale files left behind by a previous run
+// Only files created by CreateStagingFile are removed, the directory may be shared with other programs
+// Fails if files cannot be renamed from the staging directory into root
+func PrepareStagingDir(stagingDir string, root string) error {
+	if err := os.MkdirAll(stagingDir, 0700); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(stagingDir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if matched, _ := filepath.Match(INTERNAL_PREFIX+"-*.tmp", e.Name()); !matched || !e.Mode().IsRegular() {
+			continue
+		}
+
+		log.Printf("Removing stale staging file %s", filepath.Join(stagingDir, e.Name()))
+		if err = os.Remove(filepath.Join(stagingDir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	// Renaming fails if the staging directory is on a different filesystem
+	f, err := CreateStagingFile(stagingDir)
+	if err != nil {
+		return err
+	}
+	f.Close()
 
-		fileList = append(fileList, recursiveFileList...)
-		dirList = append(dirList, recursiveDirList...)
+	target := filepath.Join(root, filepath.Base(f.Name()))
+	if err = os.Rename(f.Name(), target); err != nil {
+		os.Remove(f.Name())
+		return err
 	}
 
-	return fileList, dirList, nil
+	return os.Remove(target)
 }
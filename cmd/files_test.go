@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanRelPath(t *testing.T) {
+	tests := []struct {
+		relPath string
+		want    string
+		ok      bool
+	}{
+		{"a/b", filepath.Join("a", "b"), true},
+		{"a/../b", "b", true},
+		{"./a/", "a", true},
+		{"", ".", true},
+		{"..", "", false},
+		{"../a", "", false},
+		{"a/../../b", "", false},
+		{"/etc/passwd", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := cleanRelPath(test.relPath)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("cleanRelPath(%q) = %q, %v; want %q, ok %v", test.relPath, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestSymlinkEscapes(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	if err := os.MkdirAll(filepath.Join(root, "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links the targets pass through
+	if err := os.Symlink("..", filepath.Join(root, "x", "up")); err != nil {
+		t.Skipf("Symlinks are not supported: %s", err)
+	} else if err = os.Symlink(base, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		linkDir string
+		target  string
+		escapes bool
+	}{
+		{"x", "../a", false},
+		{"x", "up", false},
+		{"x", "up/x", false},
+		{"x", "../..", true},
+		{"x", "up/..", true}, // Lexically x, but up leads to the root
+		{"x", "a/..", true},  // a could become a symlink later
+		{"x", "../out", true},
+		{"x", "../out/root/x", false},
+		{filepath.Join("new", "dir"), "../../a", false},
+		{filepath.Join("new", "dir"), "../../../a", true},
+	}
+
+	for _, test := range tests {
+		escapes, err := symlinkEscapes(root, filepath.Join(root, test.linkDir), test.target)
+		if err != nil {
+			t.Errorf("symlinkEscapes(%s, %s) failed: %s", test.linkDir, test.target, err)
+		} else if escapes != test.escapes {
+			t.Errorf("symlinkEscapes(%s, %s) = %v, want %v", test.linkDir, test.target, escapes, test.escapes)
+		}
+	}
+}
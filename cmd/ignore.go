@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const IGNORE_FILE = ".syncignore"
+
+type ignoreRule struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// IgnoreMatcher matches paths against the .syncignore files of a folder using gitignore semantics
+// Ignore files are loaded lazily and cached until invalidated
+type IgnoreMatcher struct {
+	Root string
+
+	mu    sync.Mutex
+	rules map[string][]ignoreRule // Keyed by the directory containing the ignore file, relative to root using "/"
+}
+
+var __ignoreMatchers map[string]*IgnoreMatcher = make(map[string]*IgnoreMatcher)
+var __ignoreMatchersLock sync.Mutex
+
+// Get the shared ignore matcher for a folder root
+func ignoreMatcher(root string) *IgnoreMatcher {
+	__ignoreMatchersLock.Lock()
+	defer __ignoreMatchersLock.Unlock()
+
+	m, ok := __ignoreMatchers[root]
+	if !ok {
+		m = &IgnoreMatcher{
+			Root:  root,
+			rules: make(map[string][]ignoreRule),
+		}
+		__ignoreMatchers[root] = m
+	}
+	return m
+}
+
+// Drop all cached ignore files
+func (m *IgnoreMatcher) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = make(map[string][]ignoreRule)
+}
+
+// Drop the cached ignore file of a single directory
+func (m *IgnoreMatcher) Invalidate(relDir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rules, cleanIgnoreDir(relDir))
+}
+
+// Check if a path relative to root is ignored
+// A path is also ignored if any of its parent directories are ignored, and paths used internally are always ignored
+func (m *IgnoreMatcher) Ignored(relPath string, isDir bool) bool {
+	if isInternalPath(relPath) {
+		return true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	components := strings.Split(strings.Trim(filepath.ToSlash(relPath), "/"), "/")
+	for i := 1; i <= len(components); i++ {
+		p := strings.Join(components[:i], "/")
+		if p == "" || p == "." {
+			continue
+		}
+
+		if m.match(p, i < len(components) || isDir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match a single path against the ignore files of all of its parent directories
+// Ignore files in deeper directories take precedence, as do later rules within a file
+func (m *IgnoreMatcher) match(p string, isDir bool) bool {
+	ignored := false
+	dir := ""
+	rest := p
+
+	for {
+		for _, rule := range m.load(dir) {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+
+			if rule.regex.MatchString(rest) {
+				ignored = !rule.negate
+			}
+		}
+
+		i := strings.Index(rest, "/")
+		if i < 0 {
+			return ignored
+		}
+
+		dir = path.Join(dir, rest[:i])
+		rest = rest[i+1:]
+	}
+}
+
+// Load the rules of the ignore file in a directory, caching the result
+// The caller must hold the lock
+func (m *IgnoreMatcher) load(relDir string) []ignoreRule {
+	if rules, ok := m.rules[relDir]; ok {
+		return rules
+	}
+
+	rules := []ignoreRule{}
+	f, err := os.Open(filepath.Join(m.Root, filepath.FromSlash(relDir), IGNORE_FILE))
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+		f.Close()
+	}
+
+	m.rules[relDir] = rules
+	return rules
+}
+
+func cleanIgnoreDir(relDir string) string {
+	d := path.Clean(filepath.ToSlash(relDir))
+	if d == "." || d == "/" {
+		return ""
+	}
+	return strings.Trim(d, "/")
+}
+
+// Parse a single line of an ignore file
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	rule := ignoreRule{}
+
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return rule, false
+	}
+
+	// Patterns containing a separator are relative to the directory of the ignore file
+	// Other patterns match at any depth
+	expr := "^"
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		expr += "(?:.*/)?"
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/") && (i == 0 || line[i-1] == '/'):
+			expr += "(?:.*/)?"
+			i += 2
+		case strings.HasPrefix(line[i:], "**") && i+2 == len(line) && (i == 0 || line[i-1] == '/'):
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[':
+			end := strings.Index(line[i+1:], "]")
+			if end < 0 {
+				expr += regexp.QuoteMeta(string(c))
+				continue
+			}
+
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + strings.Replace(class, "\\", "\\\\", -1) + "]"
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expr += regexp.QuoteMeta(string(line[i]))
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	expr += "$"
+
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, false
+	}
+
+	rule.regex = regex
+	return rule, true
+}
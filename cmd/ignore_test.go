@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		path    string
+		isDir   bool
+		matches bool
+	}{
+		{"*.log", "a.log", false, true},
+		{"*.log", "dir/a.log", false, true},
+		{"*.log", "a.txt", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "docs/sub/a.md", false, false},
+		{"docs/*.md", "x/docs/a.md", false, false},
+		{"**/cache", "a/b/cache", true, true},
+		{"**/cache", "cache", true, true},
+		{"logs/**", "logs/a/b.txt", false, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"[ab].txt", "a.txt", false, true},
+		{"[!ab].txt", "a.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"\\#hash", "#hash", false, true},
+		{"\\!bang", "!bang", false, true},
+		{"trailing   ", "trailing", false, true},
+		{"a.b", "axb", false, false},
+	}
+
+	for _, test := range tests {
+		rule, ok := parseIgnoreRule(test.line)
+		if !ok {
+			t.Errorf("parseIgnoreRule(%q) returned no rule", test.line)
+			continue
+		}
+
+		matches := rule.regex.MatchString(test.path) && (!rule.dirOnly || test.isDir)
+		if matches != test.matches {
+			t.Errorf("Rule %q matching %q (directory %v): got %v, want %v", test.line, test.path, test.isDir, matches, test.matches)
+		}
+	}
+}
+
+func TestParseIgnoreRuleSkipsLines(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		if _, ok := parseIgnoreRule(line); ok {
+			t.Errorf("parseIgnoreRule(%q) returned a rule", line)
+		}
+	}
+
+	rule, ok := parseIgnoreRule("!keep.log")
+	if !ok || !rule.negate || !rule.regex.MatchString("keep.log") {
+		t.Errorf("parseIgnoreRule(\"!keep.log\") = %+v, %v; want a negated rule matching keep.log", rule, ok)
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	root := t.TempDir() + string(os.PathSeparator)
+	writeIgnoreFile(t, root, "*.log\n!keep.log\nbuild/\n")
+	writeIgnoreFile(t, filepath.Join(root, "sub"), "!*.log\nlocal\n")
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{filepath.Join("build", "out.bin"), false, true},
+		{filepath.Join("sub", "a.log"), false, false},
+		{filepath.Join("sub", "local"), false, true},
+		{"local", false, false},
+		{filepath.Join(INTERNAL_PREFIX, "journal"), false, true},
+		{"a.txt", false, false},
+	}
+
+	m := ignoreMatcher(root)
+	for _, test := range tests {
+		if ignored := m.Ignored(test.path, test.isDir); ignored != test.ignored {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", test.path, test.isDir, ignored, test.ignored)
+		}
+	}
+
+	// Changed ignore files only apply once invalidated
+	writeIgnoreFile(t, root, "")
+	if !m.Ignored("a.log", false) {
+		t.Errorf("Ignore file was reloaded without being invalidated")
+	}
+
+	m.Invalidate(".")
+	if m.Ignored("a.log", false) {
+		t.Errorf("Ignore file was not reloaded after being invalidated")
+	}
+}
+
+func writeIgnoreFile(t *testing.T, dir string, contents string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, IGNORE_FILE), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Log of local changes within a folder, so that peers only need what changed since they last acknowledged
+const JOURNAL_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "journal"
+
+// Identifies the journal, so that sequence numbers acknowledged for another journal are never trusted
+const JOURNAL_ID_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "journal-id"
+
+// Last known state of every path in the folder, used to find changes made while the journal was not open
+const INDEX_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "index"
+
+// Sequence numbers acknowledged by the peers of a folder, keyed by journal ID
+const ACKS_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "acks"
+
+// The journal is compacted to the latest entry of each path once it has this many entries
+const JOURNAL_COMPACT_ENTRIES = 10000
+
+type JournalEntry struct {
+	Seq     int64       `json:"seq"`
+	RelPath string      `json:"relPath"`
+	Op      fsnotify.Op `json:"op"`
+}
+
+type IndexEntry struct {
+	ModTime int64  `json:"modTime"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+}
+
+type journalIndex struct {
+	Seq     int64                 `json:"seq"` // Every change up to this sequence number is reflected in the entries
+	Entries map[string]IndexEntry `json:"entries"`
+}
+
+// Journal records local changes within a folder with increasing sequence numbers
+type Journal struct {
+	Root string
+	ID   string
+
+	mu          sync.Mutex
+	entries     []JournalEntry
+	seq         int64 // Last sequence number handed out
+	trustedFrom int64 // Changes before this sequence number may be missing from the journal
+	durable     int64 // Last sequence number that is persisted, and may be acknowledged
+	compacted   int   // Number of entries after the last compaction
+	index       map[string]IndexEntry
+	indexDirty  bool
+	subscribers []chan struct{}
+}
+
+// Open the journal of a folder
+// Changes made while the journal was not open must be found with Reconcile before the journal is used
+func OpenJournal(root string) (*Journal, error) {
+	j := &Journal{
+		Root:  strings.TrimSuffix(root, string(os.PathSeparator)) + string(os.PathSeparator),
+		index: make(map[string]IndexEntry),
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, JOURNAL_ID_FILE))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		j.ID = strings.TrimSpace(string(data))
+	}
+
+	if j.ID == "" {
+		// New journal, any old entries belong to a journal whose ID was lost
+		id := make([]byte, 16)
+		if _, err = rand.Read(id); err != nil {
+			return nil, err
+		}
+		j.ID = hex.EncodeToString(id)
+	} else if err = j.load(); err != nil {
+		return nil, err
+	}
+
+	// Without an index, changes made while the journal was not open cannot be found
+	if j.trustedFrom == 0 {
+		j.seq++
+		j.trustedFrom = j.seq
+	}
+	j.durable = j.seq
+	return j, nil
+}
+
+// Load the entries of the journal file and the index
+func (j *Journal) load() error {
+	if data, err := ioutil.ReadFile(filepath.Join(j.Root, INDEX_FILE)); err == nil {
+		var index journalIndex
+		if err = json.Unmarshal(data, &index); err == nil && index.Entries != nil {
+			j.index = index.Entries
+			j.seq = index.Seq
+			j.trustedFrom = index.Seq
+		}
+	}
+
+	f, err := os.Open(filepath.Join(j.Root, JOURNAL_FILE))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Partially written entry
+		}
+
+		j.entries = append(j.entries, entry)
+		if entry.Seq > j.seq {
+			j.seq = entry.Seq
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Record a change of a path relative to the folder root
+func (j *Journal) Record(relPath string, op fsnotify.Op) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.updateIndex(relPath)
+	return j.record(relPath, op)
+}
+
+// Record the differences between the index and the paths that currently exist in the folder
+// This finds changes made while the journal was not open, or that were missed while it was
+func (j *Journal) Reconcile(relPaths []string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	found := make(map[string]bool)
+	for _, relPath := range relPaths {
+		found[relPath] = true
+
+		old, known := j.index[relPath]
+		if !j.updateIndex(relPath) {
+			continue // Removed since it was listed
+		}
+
+		if !known {
+			if err := j.record(relPath, fsnotify.Create); err != nil {
+				return err
+			}
+		} else if current := j.index[relPath]; current != old {
+			if err := j.record(relPath, fsnotify.Write); err != nil {
+				return err
+			}
+		}
+	}
+
+	for relPath := range j.index {
+		if found[relPath] {
+			continue
+		}
+
+		delete(j.index, relPath)
+		j.indexDirty = true
+		if err := j.record(relPath, fsnotify.Remove); err != nil {
+			return err
+		}
+	}
+
+	return j.flush()
+}
+
+// Persist the journal and the index
+func (j *Journal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.flush()
+}
+
+// Mark all changes recorded so far as untrustworthy, for example after events were lost
+func (j *Journal) Untrust() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	j.trustedFrom = j.seq
+}
+
+// Get the last sequence number
+func (j *Journal) Seq() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.seq
+}
+
+// Whether every change after a sequence number is in the journal
+func (j *Journal) Trusted(seq int64) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return seq >= j.trustedFrom && seq <= j.seq
+}
+
+// Get the last sequence number that is persisted
+// Peers must not acknowledge later ones, as they could be handed out again after a crash
+func (j *Journal) Durable() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.durable
+}
+
+// Get the latest entry of each path changed after a sequence number, in order, and the last sequence number they cover
+// Returns false if changes after the sequence number may be missing, in which case a full scan is needed
+func (j *Journal) Since(seq int64) ([]JournalEntry, int64, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq < j.trustedFrom || seq > j.seq {
+		return nil, j.seq, false
+	}
+
+	return latestEntries(j.entries, seq), j.seq, true
+}
+
+// Get a channel that is notified whenever a change is recorded
+func (j *Journal) Subscribe() chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	c := make(chan struct{}, 1)
+	j.subscribers = append(j.subscribers, c)
+	return c
+}
+
+// Record a change without updating the index
+// The caller must hold the lock
+func (j *Journal) record(relPath string, op fsnotify.Op) error {
+	j.seq++
+	entry := JournalEntry{
+		Seq:     j.seq,
+		RelPath: relPath,
+		Op:      op,
+	}
+	j.entries = append(j.entries, entry)
+
+	for _, c := range j.subscribers {
+		select {
+		case c <- struct{}{}:
+		default: // Already notified
+		}
+	}
+
+	if len(j.entries) >= JOURNAL_COMPACT_ENTRIES && len(j.entries) >= 2*j.compacted {
+		return j.compact()
+	}
+	return j.append(entry)
+}
+
+// Update the index entry of a path from its current state, returning false if it no longer exists
+// The caller must hold the lock
+func (j *Journal) updateIndex(relPath string) bool {
+	fi, err := os.Stat(j.Root + relPath)
+	if err != nil {
+		fi, err = os.Lstat(j.Root + relPath) // Broken symlink
+	}
+
+	if err != nil {
+		// Removed, along with everything beneath it
+		delete(j.index, relPath)
+		for p := range j.index {
+			if strings.HasPrefix(p, relPath+string(os.PathSeparator)) {
+				delete(j.index, p)
+			}
+		}
+		j.indexDirty = true
+		return false
+	}
+
+	entry := IndexEntry{
+		ModTime: fi.ModTime().UnixNano(),
+		Size:    fi.Size(),
+		Mode:    uint32(fi.Mode()),
+	}
+	if fi.IsDir() {
+		entry.Size = 0 // Changes with the number of entries on some filesystems
+	}
+
+	if old, ok := j.index[relPath]; !ok || old != entry {
+		j.index[relPath] = entry
+		j.indexDirty = true
+	}
+	return true
+}
+
+// Persist the journal and the index
+// The caller must hold the lock
+func (j *Journal) flush() error {
+	if j.durable == j.seq && !j.indexDirty {
+		return nil
+	}
+
+	if err := j.writeID(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.Root, JOURNAL_FILE), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&journalIndex{
+		Seq:     j.seq,
+		Entries: j.index,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(filepath.Join(j.Root, INDEX_FILE), data); err != nil {
+		return err
+	}
+
+	j.durable = j.seq
+	j.indexDirty = false
+	return nil
+}
+
+// Append an entry to the journal file
+// The caller must hold the lock
+func (j *Journal) append(entry JournalEntry) error {
+	if err := j.writeID(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.Root, JOURNAL_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Keep only the latest entry of each path, rewriting the journal file
+// The caller must hold the lock
+func (j *Journal) compact() error {
+	j.entries = latestEntries(j.entries, 0)
+	j.compacted = len(j.entries)
+
+	if err := j.writeID(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range j.entries {
+		data, err := json.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+
+	return writeFileAtomic(filepath.Join(j.Root, JOURNAL_FILE), buf.Bytes())
+}
+
+// Write the journal ID if it does not exist yet
+// The caller must hold the lock
+func (j *Journal) writeID() error {
+	path := filepath.Join(j.Root, JOURNAL_ID_FILE)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(j.Root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+
+	// Entries and the index of a previous journal must not be attributed to this one
+	for _, name := range []string{JOURNAL_FILE, INDEX_FILE} {
+		if err := os.Remove(filepath.Join(j.Root, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(j.ID+"\n"), 0600)
+}
+
+// Get the latest entry of each path with a sequence number after seq, ordered by sequence number
+func latestEntries(entries []JournalEntry, seq int64) []JournalEntry {
+	latest := make(map[string]int)
+	for i, entry := range entries {
+		if entry.Seq > seq {
+			latest[entry.RelPath] = i
+		}
+	}
+
+	result := []JournalEntry{}
+	for i, entry := range entries {
+		if entry.Seq > seq && latest[entry.RelPath] == i {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+var __acksLock sync.Mutex
+
+// Get the sequence number acknowledged for a journal in a folder, or 0 if there is none
+func LoadAck(root string, journalID string) int64 {
+	__acksLock.Lock()
+	defer __acksLock.Unlock()
+
+	return loadAcks(root)[journalID]
+}
+
+// Store the sequence number acknowledged for a journal in a folder
+func SaveAck(root string, journalID string, seq int64) error {
+	__acksLock.Lock()
+	defer __acksLock.Unlock()
+
+	acks := loadAcks(root)
+	acks[journalID] = seq
+
+	data, err := json.Marshal(acks)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Join(root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(root, ACKS_FILE), data)
+}
+
+// Forget all acknowledged sequence numbers in a folder, so that peers send everything again
+func ResetAcks(root string) error {
+	__acksLock.Lock()
+	defer __acksLock.Unlock()
+
+	if err := os.Remove(filepath.Join(root, ACKS_FILE)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The caller must hold the lock
+func loadAcks(root string) map[string]int64 {
+	acks := make(map[string]int64)
+	if data, err := ioutil.ReadFile(filepath.Join(root, ACKS_FILE)); err == nil {
+		json.Unmarshal(data, &acks) // A damaged file only causes full scans
+	}
+	return acks
+}
+
+// Replace a file atomically, as a damaged file would lose the state of all peers
+func writeFileAtomic(path string, data []byte) error {
+	staging, err := CreateStagingFile(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staging.Name()) // No-op once renamed
+
+	if _, err = staging.Write(data); err != nil {
+		staging.Close()
+		return err
+	}
+
+	if err = staging.Sync(); err != nil {
+		staging.Close()
+		return err
+	}
+
+	if err = staging.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(staging.Name(), path)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestLatestEntries(t *testing.T) {
+	entries := []JournalEntry{
+		{Seq: 1, RelPath: "a", Op: fsnotify.Create},
+		{Seq: 2, RelPath: "b", Op: fsnotify.Create},
+		{Seq: 3, RelPath: "a", Op: fsnotify.Write},
+		{Seq: 4, RelPath: "c", Op: fsnotify.Create},
+		{Seq: 5, RelPath: "b", Op: fsnotify.Remove},
+	}
+
+	tests := []struct {
+		seq  int64
+		want []JournalEntry
+	}{
+		{0, []JournalEntry{entries[2], entries[3], entries[4]}},
+		{3, []JournalEntry{entries[3], entries[4]}},
+		{5, []JournalEntry{}},
+	}
+
+	for _, test := range tests {
+		if got := latestEntries(entries, test.seq); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("latestEntries(%d) = %v, want %v", test.seq, got, test.want)
+		}
+	}
+}
+
+// The folder path may be configured without a trailing separator
+func TestJournalReconcile(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, "a.txt", "one")
+
+	j, err := OpenJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := j.Seq()
+	if err = j.Reconcile([]string{"a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, j, start, map[string]fsnotify.Op{"a.txt": fsnotify.Create})
+
+	// Changes made while the journal is closed are found when it is opened again
+	id := j.ID
+	writeTestFile(t, root, "a.txt", "changed")
+	writeTestFile(t, root, "b.txt", "new")
+	if err = os.Mkdir(filepath.Join(root, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if j, err = OpenJournal(root); err != nil {
+		t.Fatal(err)
+	} else if j.ID != id {
+		t.Fatalf("Journal ID changed from %s to %s", id, j.ID)
+	}
+
+	start = j.Seq()
+	if err = j.Reconcile([]string{"a.txt", "b.txt", "d"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, j, start, map[string]fsnotify.Op{
+		"a.txt": fsnotify.Write,
+		"b.txt": fsnotify.Create,
+		"d":     fsnotify.Create,
+	})
+
+	// Unchanged paths are not recorded again, removed ones are
+	if err = os.Remove(filepath.Join(root, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	start = j.Seq()
+	if err = j.Reconcile([]string{"a.txt", "d"}); err != nil {
+		t.Fatal(err)
+	}
+	expectEntries(t, j, start, map[string]fsnotify.Op{"b.txt": fsnotify.Remove})
+}
+
+func TestJournalTrust(t *testing.T) {
+	j, err := OpenJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing before the journal was opened is known
+	if _, _, ok := j.Since(0); ok {
+		t.Errorf("Since(0) trusted a new journal")
+	}
+
+	seq := j.Seq()
+	if err = j.Record("a", fsnotify.Create); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, upTo, ok := j.Since(seq); !ok || len(entries) != 1 || upTo != seq+1 {
+		t.Errorf("Since(%d) = %v, %d, %v; want one entry up to %d", seq, entries, upTo, ok, seq+1)
+	}
+
+	if j.Durable() > seq {
+		t.Errorf("Durable() = %d before flushing, want at most %d", j.Durable(), seq)
+	}
+
+	if err = j.Flush(); err != nil {
+		t.Fatal(err)
+	} else if j.Durable() != j.Seq() {
+		t.Errorf("Durable() = %d after flushing, want %d", j.Durable(), j.Seq())
+	}
+
+	j.Untrust()
+	if j.Trusted(seq) {
+		t.Errorf("Trusted(%d) after events were lost", seq)
+	} else if _, _, ok := j.Since(seq); ok {
+		t.Errorf("Since(%d) trusted after events were lost", seq)
+	} else if !j.Trusted(j.Seq()) {
+		t.Errorf("Trusted(%d) is false for the latest sequence number", j.Seq())
+	}
+}
+
+func TestAcks(t *testing.T) {
+	root := t.TempDir()
+	if seq := LoadAck(root, "journal:"); seq != 0 {
+		t.Errorf("LoadAck() = %d without acknowledgements, want 0", seq)
+	}
+
+	if err := SaveAck(root, "journal:", 42); err != nil {
+		t.Fatal(err)
+	} else if seq := LoadAck(root, "journal:"); seq != 42 {
+		t.Errorf("LoadAck() = %d, want 42", seq)
+	} else if seq := LoadAck(root, "other:"); seq != 0 {
+		t.Errorf("LoadAck() of another journal = %d, want 0", seq)
+	}
+
+	if err := ResetAcks(root); err != nil {
+		t.Fatal(err)
+	} else if seq := LoadAck(root, "journal:"); seq != 0 {
+		t.Errorf("LoadAck() = %d after reset, want 0", seq)
+	}
+}
+
+func expectEntries(t *testing.T, j *Journal, seq int64, want map[string]fsnotify.Op) {
+	t.Helper()
+
+	entries, _, ok := j.Since(seq)
+	if !ok {
+		t.Fatalf("Since(%d) is not trusted", seq)
+	}
+
+	got := make(map[string]fsnotify.Op)
+	for _, entry := range entries {
+		got[entry.RelPath] = entry.Op
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Since(%d) = %v, want %v", seq, got, want)
+	}
+}
+
+func writeTestFile(t *testing.T, root string, relPath string, contents string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(root, relPath), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
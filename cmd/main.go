@@ -7,19 +7,68 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Root     string      `json:"folder"`
-	Port     int64       `json:"port"`
-	Password string      `json:"password"`
-	Peers    []PeerEntry `json:"peers"`
+	Root       string        `json:"folder"` // Legacy single folder; converted to an entry in Folders
+	Port       int64         `json:"port"`
+	Password   string        `json:"password"`
+	AppendOnly bool          `json:"appendOnly"` // Peers connecting with the password may never delete or overwrite files
+	Peers      []PeerEntry   `json:"peers"`      // Peers of the legacy single folder
+	Folders    []FolderEntry `json:"folders"`
+
+	Accounts []AccountEntry `json:"accounts"` // Credentials accepted in addition to the password, each with its own permissions
+}
+
+type FolderEntry struct {
+	ID           string      `json:"id"`
+	Path         string      `json:"path"`
+	Peers        []PeerEntry `json:"peers"`
+	Symlinks     string      `json:"symlinks"`     // One of "preserve" (default), "follow" or "skip"
+	SpecialFiles string      `json:"specialFiles"` // One of "skip" (default) or "metadata"
+	IgnorePerms  bool        `json:"ignorePerms"`  // Neither send nor apply permissions
+	SyncSetuid   bool        `json:"syncSetuid"`   // Apply the setuid and setgid bits sent by peers
+	StagingDir   string      `json:"stagingDir"`   // Where received files are written before being renamed into place; must be on the same filesystem
+
+	Versioning *VersioningEntry `json:"versioning"` // Keep old copies of replaced and deleted files
+	Mode       string           `json:"mode"`       // One of "sendreceive" (default), "sendonly", "receiveonly" or "mirror"
+	Tenants    bool             `json:"tenants"`    // Confine each account to its own directory named after the account
+	Quota      int64            `json:"quota"`      // Maximum total size of files in bytes, per tenant in tenant folders; 0 for no limit
+
+	MaxDeletes       int   `json:"maxDeletes"`       // Hold back deletes once more than this many happen within the delete window; 0 for no limit
+	MaxDeletePercent int   `json:"maxDeletePercent"` // Hold back deletes once more than this percentage of items are deleted within the delete window; 0 for no limit
+	DeleteWindow     int64 `json:"deleteWindow"`     // In seconds; defaults to 60
+
+	Debounce    int64 `json:"debounce"`    // In milliseconds, how long events of a path are merged before it is sent; defaults to 500
+	StableDelay int64 `json:"stableDelay"` // In milliseconds, how long a file's size and modification time must stay the same before it is sent; defaults to 1000
+	Rescan      int64 `json:"rescan"`      // In seconds, how often the folder is scanned for changes the watcher missed; defaults to 3600
+
+	Watcher      string `json:"watcher"`      // One of "auto" (default), "notify" or "poll"
+	PollInterval int64  `json:"pollInterval"` // In seconds, how often directories are listed when polling; defaults to 10
+
+	MetadataOptions
+}
+
+type AccountEntry struct {
+	Name        string   `json:"name"`
+	Password    string   `json:"password"`
+	Folders     []string `json:"folders"`     // IDs of the folders the account may access; all if empty
+	Paths       []string `json:"paths"`       // Paths within the folders the account may access; all if empty
+	Permissions []string `json:"permissions"` // Any of "create", "update", "delete" and "read"
+	AppendOnly  bool     `json:"appendOnly"`  // Never delete or overwrite files
+	Quota       int64    `json:"quota"`       // Maximum total size of files in bytes within each of the account's paths; 0 for no limit
 }
 
 type PeerEntry struct {
-	IP       string `json:"IP"`
-	Port     int64  `json:"Port"`
-	Password string `json:"password"`
+	IP           string   `json:"IP"`
+	Port         int64    `json:"Port"`
+	Password     string   `json:"password"`
+	RemotePrefix string   `json:"remotePrefix"` // Subfolder of the peer's folder to write to
+	Include      []string `json:"include"`      // If not empty, only matching paths are sent
+	Exclude      []string `json:"exclude"`      // Matching paths are never sent
 }
 
 func main() {
@@ -28,6 +77,37 @@ func main() {
 		cname = "config.json"
 	} else if len(os.Args) == 2 && (os.Args[1] == "help" || os.Args[1] == "--help" || os.Args[1] == "-h") {
 		fmt.Printf("Usage: %s <configuration file>\n", os.Args[0])
+		fmt.Printf("       %s versions list <configuration file> <folder> [path]\n", os.Args[0])
+		fmt.Printf("       %s versions restore <configuration file> <folder> <path> <version>\n", os.Args[0])
+		fmt.Printf("       %s init <configuration file> <folder>\n", os.Args[0])
+		fmt.Printf("       %s confirm-deletes <configuration file> <folder>\n", os.Args[0])
+		fmt.Printf("       %s revert <configuration file> <folder>\n", os.Args[0])
+		fmt.Printf("       %s status <configuration file> <folder>\n", os.Args[0])
+		os.Exit(0)
+	} else if os.Args[1] == "versions" {
+		if err := runVersions(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	} else if os.Args[1] == "init" {
+		if err := runInit(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	} else if os.Args[1] == "confirm-deletes" {
+		if err := runConfirmDeletes(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	} else if os.Args[1] == "revert" {
+		if err := runRevert(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	} else if os.Args[1] == "status" {
+		if err := runStatus(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
 		os.Exit(0)
 	} else {
 		cname = os.Args[1]
@@ -40,49 +120,242 @@ func main() {
 	}
 
 	// Validate config file
-	// Test root folder for existence
-	info, err := os.Stat(config.Root)
-	if os.IsNotExist(err) {
-		log.Fatalf("The specified folder %s does not exist.", config.Root)
-	} else if !info.IsDir() {
-		log.Fatalf("The specified folder %s is not a folder.", config.Root)
+	if len(config.Folders) == 0 {
+		log.Fatal("No folders specified.")
 	}
 
-	// Check IPs
-	for i, p := range config.Peers {
-		if net.ParseIP(p.IP) == nil {
-			log.Fatalf("Invalid IP for peer %d: %s", i, p.IP)
+	folders := make(map[string]*FolderEntry)
+	for i := range config.Folders {
+		folder := &config.Folders[i]
+		if folder.ID == "" {
+			log.Fatalf("Missing ID for folder %d.", i)
+		} else if _, ok := folders[folder.ID]; ok {
+			log.Fatalf("Duplicate folder ID %s.", folder.ID)
+		}
+
+		// Test folder for existence
+		info, err := os.Stat(folder.Path)
+		if os.IsNotExist(err) {
+			log.Fatalf("The specified folder %s does not exist.", folder.Path)
+		} else if err != nil {
+			log.Fatal(err)
+		} else if !info.IsDir() {
+			log.Fatalf("The specified folder %s is not a folder.", folder.Path)
+		}
+
+		// Paths within the folder are appended to its path
+		folder.Path = strings.TrimSuffix(folder.Path, string(os.PathSeparator)) + string(os.PathSeparator)
+
+		// Check symlink policy
+		switch folder.Symlinks {
+		case "":
+			folder.Symlinks = SYMLINKS_PRESERVE
+		case SYMLINKS_PRESERVE, SYMLINKS_FOLLOW, SYMLINKS_SKIP:
+		default:
+			log.Fatalf("Invalid symlink policy for folder %s: %s", folder.ID, folder.Symlinks)
+		}
+
+		// Check special file policy
+		switch folder.SpecialFiles {
+		case "":
+			folder.SpecialFiles = SPECIALS_SKIP
+		case SPECIALS_SKIP, SPECIALS_METADATA:
+		default:
+			log.Fatalf("Invalid special file policy for folder %s: %s", folder.ID, folder.SpecialFiles)
+		}
+
+		if err = folder.MetadataOptions.Validate(); err != nil {
+			log.Fatalf("Invalid metadata options for folder %s: %s", folder.ID, err)
+		}
+
+		// Check mode
+		switch folder.Mode {
+		case "":
+			folder.Mode = MODE_SEND_RECEIVE
+		case MODE_SEND_RECEIVE, MODE_SEND_ONLY, MODE_RECEIVE_ONLY, MODE_MIRROR:
+		default:
+			log.Fatalf("Invalid mode for folder %s: %s", folder.ID, folder.Mode)
+		}
+
+		// Check versioning
+		if folder.Versioning != nil {
+			switch folder.Versioning.Type {
+			case "", VERSIONING_TRASHCAN, VERSIONING_KEEP, VERSIONING_STAGGERED:
+			default:
+				log.Fatalf("Invalid versioning type for folder %s: %s", folder.ID, folder.Versioning.Type)
+			}
+		}
+
+		// Prepare staging directory
+		if folder.StagingDir == "" {
+			folder.StagingDir = filepath.Join(folder.Path, STAGING_DIR)
+		}
+
+		if err = CheckStagingDir(folder.StagingDir, folder.Path); err != nil {
+			log.Fatalf("Invalid staging directory for folder %s: %s", folder.ID, err)
+		}
+
+		if err = PrepareStagingDir(folder.StagingDir, folder.Path); err != nil {
+			log.Printf("Unable to use staging directory %s for folder %s, staging next to each file instead: %s", folder.StagingDir, folder.ID, err)
+			folder.StagingDir = ""
 		}
-	}
 
-	// Create File Manager
-	log.Printf("Folder to synchronize: %s", config.Root)
+		// Create the folder marker if possible
+		if err = EnsureMarker(folder.Path); err != nil {
+			log.Fatal(err)
+		}
+
+		if folder.DeleteWindow <= 0 {
+			folder.DeleteWindow = 60
+		}
+
+		if folder.Debounce <= 0 {
+			folder.Debounce = 500
+		}
+
+		if folder.StableDelay <= 0 {
+			folder.StableDelay = 1000
+		}
+
+		if folder.Rescan <= 0 {
+			folder.Rescan = 3600
+		}
+
+		// Check watcher
+		switch folder.Watcher {
+		case "":
+			folder.Watcher = WATCHER_AUTO
+		case WATCHER_AUTO, WATCHER_NOTIFY, WATCHER_POLL:
+		default:
+			log.Fatalf("Invalid watcher for folder %s: %s", folder.ID, folder.Watcher)
+		}
+
+		if folder.PollInterval <= 0 {
+			folder.PollInterval = 10
+		}
+
+		// Check IPs
+		for j, p := range folder.Peers {
+			if net.ParseIP(p.IP) == nil {
+				log.Fatalf("Invalid IP for peer %d of folder %s: %s", j, folder.ID, p.IP)
+			}
+		}
+
+		folders[folder.ID] = folder
+	}
 
 	// Create Tunnels
 	done := make(chan bool)
-	for _, p := range config.Peers {
-		log.Printf("Found peer config for %s", p.IP)
+	for _, folder := range config.Folders {
+		log.Printf("Folder to synchronize: %s (%s)", folder.Path, folder.ID)
+
+		if folder.Mode == MODE_RECEIVE_ONLY {
+			log.Printf("Folder %s is receive-only, local changes are not sent to peers", folder.ID)
+			continue
+		}
 
-		t := &Tunnel{
-			IP:       p.IP,
-			Port:     p.Port,
-			Password: p.Password,
-			Root:     config.Root,
+		// Changes are recorded whether or not peers are connected
+		journal, err := OpenJournal(folder.Path)
+		if err != nil {
+			log.Printf("Unable to open journal of folder %s, not sending changes: %s", folder.ID, err)
+			continue
+		}
+
+		// Deletes are counted across all peers of the folder
+		guard := &DeleteGuard{
+			Root:       folder.Path,
+			MaxDeletes: folder.MaxDeletes,
+			MaxPercent: folder.MaxDeletePercent,
+			Window:     time.Duration(folder.DeleteWindow) * time.Second,
+		}
+
+		watcher := &FolderWatcher{
+			Root:        folder.Path,
+			Symlinks:    folder.Symlinks,
+			Journal:     journal,
+			Debounce:    time.Duration(folder.Debounce) * time.Millisecond,
+			StableDelay: time.Duration(folder.StableDelay) * time.Millisecond,
+			Rescan:      time.Duration(folder.Rescan) * time.Second,
+			Type:        folder.Watcher,
+			Poll:        time.Duration(folder.PollInterval) * time.Second,
+			DeleteGuard: guard,
 		}
 
-		if err := t.Setup(); err != nil {
-			log.Printf("[%s:%s] Error setting up peer: %s", p.IP, p.Port, err)
+		if err = watcher.Start(); err != nil {
+			log.Printf("Unable to watch folder %s, not sending changes: %s", folder.ID, err)
 			continue
 		}
 
-		go t.Start()
+		for _, p := range folder.Peers {
+			log.Printf("Found peer config for %s in folder %s", p.IP, folder.ID)
+
+			t := &Tunnel{
+				IP:       p.IP,
+				Port:     p.Port,
+				Password: p.Password,
+				FolderID: folder.ID,
+				Root:     folder.Path,
+
+				RemotePrefix: p.RemotePrefix,
+				Include:      p.Include,
+				Exclude:      p.Exclude,
+				Symlinks:     folder.Symlinks,
+				IgnorePerms:  folder.IgnorePerms,
+				Metadata:     folder.MetadataOptions,
+				DeleteGuard:  guard,
+				Mirror:       folder.Mode == MODE_MIRROR,
+				Specials:     folder.SpecialFiles,
+				Journal:      journal,
+				Watcher:      watcher,
+			}
+
+			if err := t.Setup(); err != nil {
+				log.Printf("[%v:%v] Error setting up peer: %s", p.IP, p.Port, err)
+				continue
+			}
+
+			go t.Start()
+		}
 	}
 
+	// Accounts accepted by the server
+	// The password is shorthand for an account with all permissions on all folders
+	accounts := []*Account{}
 	if config.Password != "" {
+		accounts = append(accounts, &Account{
+			AccountEntry: AccountEntry{
+				Name:        "default",
+				Password:    config.Password,
+				Permissions: ALL_PERMISSIONS,
+				AppendOnly:  config.AppendOnly,
+			},
+		})
+	}
+
+	for i := range config.Accounts {
+		entry := config.Accounts[i]
+		if err := validateAccount(&entry, folders); err != nil {
+			log.Fatalf("Invalid account %d: %s", i, err)
+		}
+
+		for _, a := range accounts {
+			if a.Name == entry.Name {
+				log.Fatalf("Duplicate account name %s.", entry.Name)
+			} else if a.Password == entry.Password {
+				log.Fatalf("Account %s has the same password as account %s.", entry.Name, a.Name)
+			}
+		}
+
+		accounts = append(accounts, &Account{
+			AccountEntry: entry,
+		})
+	}
+
+	if len(accounts) > 0 {
 		server := &Server{
 			Port:     config.Port,
-			Password: config.Password,
-			Root:     config.Root,
+			Accounts: accounts,
+			Folders:  folders,
 		}
 		server.Start()
 	}
@@ -108,5 +381,14 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	// A top-level folder is shorthand for a single folder with the default ID
+	if config.Root != "" {
+		config.Folders = append(config.Folders, FolderEntry{
+			ID:    "default",
+			Path:  config.Root,
+			Peers: config.Peers,
+		})
+	}
+
 	return config, nil
 }
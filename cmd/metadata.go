@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// Metadata that is optionally replicated along with the modification time
+type FileMetadata struct {
+	Xattrs map[string][]byte `json:"xattrs,omitempty"` // Extended attributes, including POSIX ACLs if enabled
+	Owner  string            `json:"owner,omitempty"`  // User name of the owner; empty if unknown
+	Group  string            `json:"group,omitempty"`  // Group name of the owner; empty if unknown
+	Uid    int               `json:"uid"`
+	Gid    int               `json:"gid"`
+}
+
+// Which metadata is replicated for a folder
+type MetadataOptions struct {
+	Xattrs     bool              `json:"syncXattrs"`
+	XattrAllow []string          `json:"xattrAllow"` // Patterns of the extended attributes that are replicated; only "user.*" if empty
+	ACLs       bool              `json:"syncACLs"`
+	Ownership  bool              `json:"syncOwnership"` // Only applied when running as root
+	UserMap    map[string]string `json:"userMap"`       // Maps user names of peers to local user names
+	GroupMap   map[string]string `json:"groupMap"`      // Maps group names of peers to local group names
+}
+
+// Extended attributes replicated unless others are allowed
+// Other namespaces carry security labels, capabilities and data of the system, which peers must not set
+const XATTR_DEFAULT_ALLOW = "user.*"
+
+// Extended attributes used to store POSIX ACLs
+var aclXattrs = map[string]bool{
+	"system.posix_acl_access":  true,
+	"system.posix_acl_default": true,
+}
+
+func (o *MetadataOptions) Enabled() bool {
+	return o.Xattrs || o.ACLs || o.Ownership
+}
+
+// Check if an extended attribute is replicated
+func (o *MetadataOptions) syncsXattr(name string) bool {
+	if aclXattrs[name] {
+		return o.ACLs
+	} else if !o.Xattrs {
+		return false
+	}
+
+	allow := o.XattrAllow
+	if len(allow) == 0 {
+		allow = []string{XATTR_DEFAULT_ALLOW}
+	}
+
+	for _, pattern := range allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the patterns of allowed extended attributes
+func (o *MetadataOptions) Validate() error {
+	for _, pattern := range o.XattrAllow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid extended attribute pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
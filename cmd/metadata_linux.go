@@ -0,0 +1,200 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Read the replicated metadata of a file or directory
+func ReadMetadata(fqpath string, opts *MetadataOptions) (*FileMetadata, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+
+	meta := &FileMetadata{}
+
+	if opts.Xattrs || opts.ACLs {
+		names, err := listXattrs(fqpath)
+		if err != nil {
+			return nil, err
+		}
+
+		meta.Xattrs = make(map[string][]byte)
+		for _, name := range names {
+			if !opts.syncsXattr(name) {
+				continue
+			}
+
+			value, err := getXattr(fqpath, name)
+			if err == syscall.ENODATA {
+				continue // Removed while reading
+			} else if err != nil {
+				return nil, err
+			}
+			meta.Xattrs[name] = value
+		}
+	}
+
+	if opts.Ownership {
+		fi, err := os.Lstat(fqpath)
+		if err != nil {
+			return nil, err
+		}
+
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			meta.Uid = int(stat.Uid)
+			meta.Gid = int(stat.Gid)
+			if u, err := user.LookupId(strconv.Itoa(meta.Uid)); err == nil {
+				meta.Owner = u.Username
+			}
+			if g, err := user.LookupGroupId(strconv.Itoa(meta.Gid)); err == nil {
+				meta.Group = g.Name
+			}
+		}
+	}
+
+	return meta, nil
+}
+
+// Apply metadata received from a peer to a file or directory
+// Returns true if anything was changed
+func ApplyMetadata(fqpath string, meta *FileMetadata, opts *MetadataOptions) (bool, error) {
+	if meta == nil || !opts.Enabled() {
+		return false, nil
+	}
+
+	changed := false
+
+	if opts.Xattrs || opts.ACLs {
+		names, err := listXattrs(fqpath)
+		if err != nil {
+			return changed, err
+		}
+
+		// Remove attributes that no longer exist on the peer
+		for _, name := range names {
+			if _, ok := meta.Xattrs[name]; ok || !opts.syncsXattr(name) {
+				continue
+			}
+
+			if err = syscall.Removexattr(fqpath, name); err != nil && err != syscall.ENODATA {
+				return changed, err
+			}
+			changed = true
+		}
+
+		for name, value := range meta.Xattrs {
+			if !opts.syncsXattr(name) {
+				continue
+			}
+
+			if existing, err := getXattr(fqpath, name); err == nil && bytes.Equal(existing, value) {
+				continue
+			}
+
+			if err = syscall.Setxattr(fqpath, name, value, 0); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	// Only root may give files away
+	if opts.Ownership && os.Geteuid() == 0 {
+		fi, err := os.Lstat(fqpath)
+		if err != nil {
+			return changed, err
+		}
+
+		uid := lookupUid(meta.Owner, meta.Uid, opts.UserMap)
+		gid := lookupGid(meta.Group, meta.Gid, opts.GroupMap)
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && (int(stat.Uid) != uid || int(stat.Gid) != gid) {
+			if err = os.Lchown(fqpath, uid, gid); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// Resolve a user by name, falling back to the numeric ID if the user does not exist locally
+func lookupUid(name string, uid int, userMap map[string]string) int {
+	if mapped, ok := userMap[name]; ok {
+		name = mapped
+	}
+
+	if name != "" {
+		if u, err := user.Lookup(name); err == nil {
+			if id, err := strconv.Atoi(u.Uid); err == nil {
+				return id
+			}
+		}
+	}
+	return uid
+}
+
+// Resolve a group by name, falling back to the numeric ID if the group does not exist locally
+func lookupGid(name string, gid int, groupMap map[string]string) int {
+	if mapped, ok := groupMap[name]; ok {
+		name = mapped
+	}
+
+	if name != "" {
+		if g, err := user.LookupGroup(name); err == nil {
+			if id, err := strconv.Atoi(g.Gid); err == nil {
+				return id
+			}
+		}
+	}
+	return gid
+}
+
+func listXattrs(fqpath string) ([]string, error) {
+	size, err := syscall.Listxattr(fqpath, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil // Filesystem does not support extended attributes
+	} else if err != nil {
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(fqpath, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(fqpath string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(fqpath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(fqpath, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
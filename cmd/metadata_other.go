@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Extended attributes, ACLs and ownership are only replicated on Linux
+func ReadMetadata(fqpath string, opts *MetadataOptions) (*FileMetadata, error) {
+	return nil, nil
+}
+
+func ApplyMetadata(fqpath string, meta *FileMetadata, opts *MetadataOptions) (bool, error) {
+	return false, nil
+}
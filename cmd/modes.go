@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FolderEntry.Mode
+const (
+	MODE_SEND_RECEIVE = "sendreceive" // Send local changes and accept changes from peers
+	MODE_SEND_ONLY    = "sendonly"    // Send local changes and ignore changes from peers
+	MODE_RECEIVE_ONLY = "receiveonly" // Accept changes from peers and never send local changes
+	MODE_MIRROR       = "mirror"      // Make peers an exact copy, deleting anything that does not exist locally, and ignore changes from peers
+)
+
+// Log of everything received into a receive-only folder, used to revert local changes
+const RECEIVED_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "received"
+
+type ReceivedEntry struct {
+	RelPath string `json:"relPath"`
+	ModTime int64  `json:"modTime"`
+	Size    int64  `json:"size"`
+	Deleted bool   `json:"deleted"`
+}
+
+var __receivedLock sync.Mutex
+
+// Append an entry for a received path to the log of a receive-only folder
+func RecordReceived(root string, relPath string) error {
+	entry := &ReceivedEntry{
+		RelPath: relPath,
+	}
+
+	fi, err := os.Lstat(root + relPath)
+	if err != nil && os.IsNotExist(err) {
+		entry.Deleted = true
+	} else if err != nil {
+		return err
+	} else {
+		entry.ModTime = fi.ModTime().UnixNano()
+		entry.Size = fi.Size()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	__receivedLock.Lock()
+	defer __receivedLock.Unlock()
+
+	if err = os.MkdirAll(filepath.Join(root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(root, RECEIVED_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Load the latest entry of each path received into a receive-only folder
+func LoadReceived(root string) (map[string]*ReceivedEntry, error) {
+	received := make(map[string]*ReceivedEntry)
+
+	f, err := os.Open(filepath.Join(root, RECEIVED_FILE))
+	if err != nil && os.IsNotExist(err) {
+		return received, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := &ReceivedEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue // Partially written entry
+		}
+
+		if entry.Deleted {
+			delete(received, entry.RelPath)
+		} else {
+			received[entry.RelPath] = entry
+		}
+	}
+
+	return received, scanner.Err()
+}
+
+// Revert local changes in a receive-only folder
+// Locally added and modified paths are removed, so that peers send their version again on the next synchronization
+// Removed files are kept as versions if a versioner is given
+func RevertLocalChanges(root string, ignore *IgnoreMatcher, symlinks string, versioner *Versioner) error {
+	received, err := LoadReceived(root)
+	if err != nil {
+		return err
+	}
+
+	items, err := ListItems(root, "", ignore, symlinks)
+	if err != nil {
+		return err
+	}
+
+	for _, relPath := range append(append(items.Files, items.Links...), items.Specials...) {
+		fi, err := os.Lstat(root + relPath)
+		if err != nil {
+			return err
+		}
+
+		entry, ok := received[relPath]
+		if !ok {
+			log.Printf("Reverting locally added %s", relPath)
+		} else if fi.Mode().IsRegular() && (fi.ModTime().UnixNano() != entry.ModTime || fi.Size() != entry.Size) {
+			log.Printf("Reverting locally modified %s", relPath)
+		} else {
+			continue
+		}
+
+		if err = RemoveUnignored(root, relPath, ignore, versioner); err != nil {
+			return err
+		}
+	}
+
+	// Directories containing received paths are kept even if they were not received themselves
+	needed := make(map[string]bool)
+	for relPath := range received {
+		for dir := relPath; dir != "." && !needed[dir]; dir = filepath.Dir(dir) {
+			needed[dir] = true
+		}
+	}
+
+	// Remove locally added directories, deepest first
+	sort.Sort(sort.Reverse(sort.StringSlice(items.Dirs)))
+	for _, relPath := range items.Dirs {
+		if needed[relPath] {
+			continue
+		}
+
+		log.Printf("Reverting locally added directory %s", relPath)
+		if err = RemoveUnignored(root, relPath, ignore, versioner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List everything within an area of a folder that is not in a list of paths
+// Listed paths are relative to the area, and their parent directories are kept
+// Returns the unlisted paths relative to the folder root, directories before their contents
+func UnlistedPaths(root string, prefix string, paths []string, ignore *IgnoreMatcher) ([]string, error) {
+	keep := make(map[string]bool)
+	for _, p := range paths {
+		cleaned, err := cleanRelPath(p)
+		if err != nil {
+			return nil, err
+		}
+
+		for cleaned != "." && !keep[cleaned] {
+			keep[cleaned] = true
+			cleaned = filepath.Dir(cleaned)
+		}
+	}
+
+	items, err := ListItems(root+prefix, prefix, ignore, SYMLINKS_PRESERVE)
+	if err != nil {
+		return nil, err
+	}
+
+	unlisted := []string{}
+	for _, list := range [][]string{items.Dirs, items.Files, items.Links, items.Specials} {
+		for _, localPath := range list {
+			if !keep[strings.TrimPrefix(localPath, prefix)] {
+				unlisted = append(unlisted, localPath)
+			}
+		}
+	}
+
+	return unlisted, nil
+}
+
+// Check if a path is beneath any of a list of directories
+func isBeneath(relPath string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(relPath, d+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Changes waiting to be sent, one file per peer
+const QUEUES_DIR = INTERNAL_PREFIX + string(os.PathSeparator) + "queues"
+
+// A change waiting to be sent to a peer
+type QueueItem struct {
+	Op       fsnotify.Op `json:"op"`
+	Seq      int64       `json:"seq"`      // Journal sequence number of the latest change of the path
+	Attempts int         `json:"attempts"` // Failed attempts so far
+	Next     time.Time   `json:"-"`        // When to try again after a failure
+}
+
+type queueState struct {
+	Peer      string                `json:"peer"`
+	JournalID string                `json:"journalID"`
+	Cursor    int64                 `json:"cursor"` // Every journal entry up to this sequence number is in the queue or was sent
+	Acked     int64                 `json:"acked"`  // Last sequence number acknowledged by the peer
+	Resync    bool                  `json:"resync"` // Changes were lost, the whole folder must be synchronized
+	Items     map[string]*QueueItem `json:"items"`
+}
+
+// PeerQueue keeps the changes that a peer has not received yet, at most one per path
+// It is filled from the journal whether or not the peer is connected, and persisted so that it survives restarts
+type PeerQueue struct {
+	Path    string
+	Journal *Journal
+	Changes chan struct{} // Notified when changes are queued
+
+	mu    sync.Mutex
+	state queueState
+	dirty bool
+}
+
+// Open the queue of a peer of a folder
+// A new queue, or one for another journal, starts with a full synchronization
+func OpenPeerQueue(root string, peer string, journal *Journal) (*PeerQueue, error) {
+	sum := sha256.Sum256([]byte(peer))
+	q := &PeerQueue{
+		Path:    filepath.Join(root, QUEUES_DIR, hex.EncodeToString(sum[:8])),
+		Journal: journal,
+		Changes: make(chan struct{}, 1),
+	}
+
+	data, err := ioutil.ReadFile(q.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		json.Unmarshal(data, &q.state) // A damaged queue only causes a full synchronization
+	}
+
+	if q.state.JournalID != journal.ID || q.state.Items == nil {
+		q.state = queueState{
+			Resync: true,
+			Items:  make(map[string]*QueueItem),
+		}
+	}
+	q.state.Peer = peer
+	q.state.JournalID = journal.ID
+	q.dirty = true
+
+	q.fill()
+	return q, nil
+}
+
+// Queue changes from the journal as they are recorded, and persist the queue periodically
+func (q *PeerQueue) Run() {
+	changes := q.Journal.Subscribe()
+	ticker := time.NewTicker(JOURNAL_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-changes:
+			q.fill()
+		case <-ticker.C:
+			if err := q.Save(); err != nil {
+				log.Printf("Unable to persist queue %s: %s", q.Path, err)
+			}
+		}
+	}
+}
+
+// Queue the journal entries that are not queued yet
+func (q *PeerQueue) fill() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries, upTo, ok := q.Journal.Since(q.state.Cursor)
+	if !ok {
+		// Changes were lost
+		q.state.Resync = true
+	}
+
+	for _, entry := range entries {
+		q.add(entry.RelPath, entry.Op, entry.Seq)
+	}
+
+	if len(entries) > 0 || q.state.Cursor != upTo {
+		q.state.Cursor = upTo
+		q.dirty = true
+		q.notify()
+	}
+}
+
+// Merge a change into the queue
+// The caller must hold the lock
+func (q *PeerQueue) add(relPath string, op fsnotify.Op, seq int64) {
+	item, ok := q.state.Items[relPath]
+	if !ok {
+		q.state.Items[relPath] = &QueueItem{Op: op, Seq: seq}
+		return
+	}
+
+	item.Op = mergeOps(item.Op, op)
+	if seq > item.Seq {
+		item.Seq = seq
+	}
+	item.Attempts = 0
+	item.Next = time.Time{}
+}
+
+// Merge two changes of the same path into one
+// A delete replaces everything before it, anything after a delete replaces the delete
+func mergeOps(old fsnotify.Op, op fsnotify.Op) fsnotify.Op {
+	if op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		return op
+	}
+	return old&^(fsnotify.Remove|fsnotify.Rename) | op
+}
+
+// The caller must hold the lock
+func (q *PeerQueue) notify() {
+	select {
+	case q.Changes <- struct{}{}:
+	default: // Already notified
+	}
+}
+
+// Get the paths that are due to be sent, in the order they changed
+func (q *PeerQueue) Due() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	paths := []string{}
+	for relPath, item := range q.state.Items {
+		if !now.Before(item.Next) {
+			paths = append(paths, relPath)
+		}
+	}
+
+	sort.Slice(paths, func(a, b int) bool {
+		return q.state.Items[paths[a]].Seq < q.state.Items[paths[b]].Seq
+	})
+	return paths
+}
+
+// Get the queued change of a path
+func (q *PeerQueue) Get(relPath string) (QueueItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.state.Items[relPath]
+	if !ok {
+		return QueueItem{}, false
+	}
+	return *item, true
+}
+
+// Remove a path that was sent, unless it changed again since the given sequence number
+func (q *PeerQueue) Done(relPath string, seq int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if item, ok := q.state.Items[relPath]; ok && item.Seq <= seq {
+		delete(q.state.Items, relPath)
+		q.dirty = true
+	}
+}
+
+// Keep a path that failed to be sent, returning how long to wait before trying again
+func (q *PeerQueue) Fail(relPath string, op fsnotify.Op, seq int64) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.state.Items[relPath]
+	if !ok {
+		item = &QueueItem{Op: op, Seq: seq}
+		q.state.Items[relPath] = item
+	}
+
+	delay := RETRY_MAX_DELAY
+	if item.Attempts < 10 {
+		if d := RETRY_MIN_DELAY << uint(item.Attempts); d < delay {
+			delay = d
+		}
+	}
+
+	item.Attempts++
+	item.Next = time.Now().Add(delay)
+	q.dirty = true
+	return delay
+}
+
+// Keep a path whose change is held back, checking it again after a delay without counting it as a failure
+func (q *PeerQueue) Hold(relPath string, op fsnotify.Op, seq int64, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.state.Items[relPath]
+	if !ok {
+		item = &QueueItem{Op: op, Seq: seq}
+		q.state.Items[relPath] = item
+	}
+
+	item.Next = time.Now().Add(delay)
+	q.dirty = true
+}
+
+// Whether the whole folder must be synchronized
+func (q *PeerQueue) NeedsResync() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.state.Resync
+}
+
+// Start a full synchronization, which covers everything queued so far except deletes
+func (q *PeerQueue) StartResync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.state.Resync = false
+	q.dirty = true
+}
+
+// Get the last sequence number up to which every change was sent, or false during a full synchronization
+func (q *PeerQueue) Delivered() (int64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.state.Resync {
+		return 0, false
+	}
+
+	seq := q.state.Cursor
+	for _, item := range q.state.Items {
+		if item.Seq-1 < seq {
+			seq = item.Seq - 1
+		}
+	}
+	return seq, true
+}
+
+// Get the last sequence number acknowledged by the peer
+func (q *PeerQueue) Acked() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.state.Acked
+}
+
+// Remember the last sequence number acknowledged by the peer
+func (q *PeerQueue) SetAcked(seq int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.state.Acked = seq
+	q.dirty = true
+}
+
+// Number of paths waiting to be sent
+func (q *PeerQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.state.Items)
+}
+
+// Persist the queue if it changed
+func (q *PeerQueue) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.dirty {
+		return nil
+	}
+
+	// Entries the journal may still lose must be queued again after a crash
+	state := q.state
+	if durable := q.Journal.Durable(); durable < state.Cursor {
+		state.Cursor = durable
+	}
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(q.Path), 0700); err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(q.Path, data); err != nil {
+		return err
+	}
+
+	q.dirty = false
+	return nil
+}
+
+// Summary of a persisted queue
+type QueueStatus struct {
+	Peer   string
+	Depth  int
+	Resync bool
+}
+
+// Read the persisted queues of all peers of a folder
+func LoadQueueStatus(root string) ([]QueueStatus, error) {
+	files, err := ioutil.ReadDir(filepath.Join(root, QUEUES_DIR))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := []QueueStatus{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(root, QUEUES_DIR, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var state queueState
+		if err = json.Unmarshal(data, &state); err != nil {
+			continue // Staging file or damaged queue
+		}
+
+		result = append(result, QueueStatus{
+			Peer:   state.Peer,
+			Depth:  len(state.Items),
+			Resync: state.Resync,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestMergeOps(t *testing.T) {
+	tests := []struct {
+		old  fsnotify.Op
+		op   fsnotify.Op
+		want fsnotify.Op
+	}{
+		{fsnotify.Create, fsnotify.Write, fsnotify.Create | fsnotify.Write},
+		{fsnotify.Write, fsnotify.Chmod, fsnotify.Write | fsnotify.Chmod},
+		{fsnotify.Create | fsnotify.Write, fsnotify.Remove, fsnotify.Remove},
+		{fsnotify.Write, fsnotify.Rename, fsnotify.Rename},
+		{fsnotify.Remove, fsnotify.Create, fsnotify.Create},
+		{fsnotify.Rename, fsnotify.Write, fsnotify.Write},
+	}
+
+	for _, test := range tests {
+		if got := mergeOps(test.old, test.op); got != test.want {
+			t.Errorf("mergeOps(%v, %v) = %v, want %v", test.old, test.op, got, test.want)
+		}
+	}
+}
+
+func TestPeerQueue(t *testing.T) {
+	root := t.TempDir()
+	j, err := OpenJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := OpenPeerQueue(root, "peer:1234", j)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new queue starts with a full synchronization
+	if !q.NeedsResync() {
+		t.Fatalf("New queue does not need a full synchronization")
+	} else if _, ok := q.Delivered(); ok {
+		t.Errorf("Delivered() during a full synchronization")
+	}
+	q.StartResync()
+
+	seq := j.Seq()
+	for _, change := range []struct {
+		relPath string
+		op      fsnotify.Op
+	}{
+		{"a", fsnotify.Create},
+		{"b", fsnotify.Create},
+		{"a", fsnotify.Write},
+		{"c", fsnotify.Create},
+		{"b", fsnotify.Remove},
+	} {
+		if err = j.Record(change.relPath, change.op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.fill()
+
+	// One change per path, in the order of their latest change
+	if due := q.Due(); !reflect.DeepEqual(due, []string{"a", "c", "b"}) {
+		t.Errorf("Due() = %v, want [a c b]", due)
+	}
+
+	if item, _ := q.Get("a"); item.Op != fsnotify.Write || item.Seq != seq+3 {
+		t.Errorf("Get(a) = %+v, want Write with sequence number %d", item, seq+3)
+	} else if item, _ := q.Get("b"); item.Op != fsnotify.Remove {
+		t.Errorf("Get(b) = %+v, want Remove", item)
+	}
+
+	// Paths that changed again after they were sent stay queued
+	q.Done("a", seq+1)
+	if _, ok := q.Get("a"); !ok {
+		t.Errorf("Done() removed a path that changed since")
+	}
+
+	q.Done("a", seq+3)
+	if _, ok := q.Get("a"); ok {
+		t.Errorf("Done() kept a path that was sent")
+	}
+
+	// Only changes before the first queued one are delivered
+	if delivered, ok := q.Delivered(); !ok || delivered != seq+3 {
+		t.Errorf("Delivered() = %d, %v; want %d", delivered, ok, seq+3)
+	}
+
+	// Failed paths wait before they are retried, with a growing delay
+	if delay := q.Fail("c", fsnotify.Create, seq+4); delay != RETRY_MIN_DELAY {
+		t.Errorf("First Fail() delay = %s, want %s", delay, RETRY_MIN_DELAY)
+	} else if delay = q.Fail("c", fsnotify.Create, seq+4); delay != 2*RETRY_MIN_DELAY {
+		t.Errorf("Second Fail() delay = %s, want %s", delay, 2*RETRY_MIN_DELAY)
+	}
+
+	// Held paths wait as well, without counting as failures
+	q.Hold("b", fsnotify.Remove, seq+5, time.Minute)
+	if due := q.Due(); len(due) != 0 {
+		t.Errorf("Due() = %v with every path waiting, want none", due)
+	} else if item, _ := q.Get("b"); item.Attempts != 0 {
+		t.Errorf("Hold() counted %d attempts", item.Attempts)
+	}
+
+	// Queued paths survive a restart, and are due again at once
+	if err = j.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err = q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q, err = OpenPeerQueue(root, "peer:1234", j); err != nil {
+		t.Fatal(err)
+	} else if q.NeedsResync() {
+		t.Errorf("Reopened queue needs a full synchronization")
+	} else if due := q.Due(); !reflect.DeepEqual(due, []string{"c", "b"}) {
+		t.Errorf("Due() after reopening = %v, want [c b]", due)
+	}
+
+	// Changes missing from the journal require a full synchronization
+	j.Untrust()
+	q.fill()
+	if !q.NeedsResync() {
+		t.Errorf("Queue does not need a full synchronization after changes were lost")
+	}
+}
+
+func TestPeerQueueOtherJournal(t *testing.T) {
+	root := t.TempDir()
+	j, err := OpenJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := OpenPeerQueue(root, "peer:1234", j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.StartResync()
+	if err = q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A queue of another journal is of no use
+	other := &Journal{Root: root, ID: "other"}
+	if q, err = OpenPeerQueue(root, "peer:1234", other); err != nil {
+		t.Fatal(err)
+	} else if !q.NeedsResync() {
+		t.Errorf("Queue of another journal does not need a full synchronization")
+	}
+}
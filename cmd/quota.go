@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Space that must remain free on the filesystem after a received file is written
+const MIN_FREE_SPACE = 16 * 1024 * 1024
+
+// How long the usage of a directory is trusted before it is computed again
+// Files may change without being received, for example when edited locally or when versions are removed
+const USAGE_MAX_AGE = 10 * time.Minute
+
+type usageEntry struct {
+	Size int64
+	At   time.Time // When the size was computed
+}
+
+// Total size of the files beneath directories, keyed by the fully qualified directory with trailing separator
+// Computed when first needed, kept up to date as files are received and computed again once it is too old
+var __usage map[string]usageEntry = make(map[string]usageEntry)
+var __usageLock sync.Mutex
+
+// Get the total size of the files beneath a directory
+func DiskUsage(dir string) (int64, error) {
+	dir = strings.TrimSuffix(dir, string(os.PathSeparator)) + string(os.PathSeparator)
+
+	__usageLock.Lock()
+	entry, ok := __usage[dir]
+	__usageLock.Unlock()
+	if ok && time.Since(entry.At) < USAGE_MAX_AGE {
+		return entry.Size, nil
+	}
+
+	var usage int64
+	computedAt := time.Now()
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			usage += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	__usageLock.Lock()
+	defer __usageLock.Unlock()
+	__usage[dir] = usageEntry{Size: usage, At: computedAt}
+	return usage, nil
+}
+
+// Adjust the usage of all directories containing a path after it grew or shrank by a known number of bytes
+func AdjustUsage(fqpath string, delta int64) {
+	__usageLock.Lock()
+	defer __usageLock.Unlock()
+
+	for dir, entry := range __usage {
+		if strings.HasPrefix(fqpath, dir) {
+			entry.Size += delta
+			__usage[dir] = entry
+		}
+	}
+}
+
+// Forget the usage of all directories containing a path after it changed by an unknown number of bytes
+func InvalidateUsage(fqpath string) {
+	__usageLock.Lock()
+	defer __usageLock.Unlock()
+
+	for dir := range __usage {
+		if strings.HasPrefix(fqpath, dir) {
+			delete(__usage, dir)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Marker that must exist within a folder before anything is sent, so that an unmounted or removed folder is never replicated as empty
+const MARKER_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "marker"
+
+// Touched by the confirm-deletes command to release deletes held back by a DeleteGuard
+const CONFIRM_DELETES_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "confirm-deletes"
+
+// Check if the marker exists within a folder
+func HasMarker(root string) bool {
+	_, err := os.Stat(filepath.Join(root, MARKER_FILE))
+	return err == nil
+}
+
+// Create the marker within a folder
+func CreateMarker(root string) error {
+	if err := os.MkdirAll(filepath.Join(root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(root, MARKER_FILE), []byte{}, 0600)
+}
+
+// Create the marker within a folder if it is missing and the folder is not empty
+// An empty folder may be an unmounted mount point, so its marker must be created explicitly
+func EnsureMarker(root string) error {
+	if HasMarker(root) {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !isInternalPath(e.Name()) {
+			log.Printf("Creating folder marker in %s", root)
+			return CreateMarker(root)
+		}
+	}
+
+	log.Printf("Folder %s is empty and has no marker, nothing will be sent until it is created with the init command", root)
+	return nil
+}
+
+// DeleteGuard holds back deletes in a folder once too many happen within a window, until they are confirmed
+type DeleteGuard struct {
+	Root       string
+	MaxDeletes int           // Maximum number of deletes within the window; 0 for no limit
+	MaxPercent int           // Maximum percentage of known items deleted within the window; 0 for no limit
+	Window     time.Duration // Window in which deletes are counted
+
+	mu         sync.Mutex
+	knownItems int
+	recent     []time.Time
+	pausedAt   time.Time        // Zero if deletes are not held back
+	pending    map[string]int64 // Held back deletes and their delete times
+	released   int              // Incremented whenever held back deletes are released
+}
+
+// Set the number of items in the folder, used for the percentage limit
+func (g *DeleteGuard) SetKnownItems(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.knownItems = n
+}
+
+// Check if a new delete may be sent
+// Returns false if the delete is held back, in which case it is sent once deletes are confirmed
+func (g *DeleteGuard) Allow(relPath string, delTime int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.MaxDeletes <= 0 && g.MaxPercent <= 0 {
+		return true
+	}
+
+	if !g.pausedAt.IsZero() {
+		g.pending[relPath] = delTime
+		return false
+	}
+
+	// Count deletes within the window
+	now := time.Now()
+	recent := []time.Time{}
+	for _, t := range g.recent {
+		if now.Sub(t) < g.Window {
+			recent = append(recent, t)
+		}
+	}
+	g.recent = append(recent, now)
+
+	exceeded := g.MaxDeletes > 0 && len(g.recent) > g.MaxDeletes
+	if g.MaxPercent > 0 && g.knownItems > 0 && len(g.recent)*100 > g.knownItems*g.MaxPercent {
+		exceeded = true
+	}
+
+	if !exceeded {
+		return true
+	}
+
+	log.Printf("%d deletes within %s in %s, holding back deletes until confirmed with the confirm-deletes command", len(g.recent), g.Window, g.Root)
+	g.pausedAt = now
+	g.pending = map[string]int64{relPath: delTime}
+	return false
+}
+
+// Check if a delete is currently held back
+func (g *DeleteGuard) Held(relPath string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.pending[relPath]
+	return ok
+}
+
+// Release held back deletes if they have been confirmed since they were held back
+// Released deletes are added to the delete times of the folder
+// Returns a counter that changes whenever deletes are released
+func (g *DeleteGuard) CheckConfirmed(folderID string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.pausedAt.IsZero() {
+		return g.released
+	}
+
+	fi, err := os.Stat(filepath.Join(g.Root, CONFIRM_DELETES_FILE))
+	if err != nil || fi.ModTime().Before(g.pausedAt) {
+		return g.released
+	}
+
+	log.Printf("Releasing %d confirmed deletes in %s", len(g.pending), g.Root)
+	for relPath, delTime := range g.pending {
+		setDeleteTime(folderID, relPath, delTime)
+	}
+
+	g.pausedAt = time.Time{}
+	g.pending = nil
+	g.recent = nil
+	g.released++
+	return g.released
+}
+
+// Confirm held back deletes in a folder
+func ConfirmDeletes(root string) error {
+	if err := os.MkdirAll(filepath.Join(root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	path := filepath.Join(root, CONFIRM_DELETES_FILE)
+	if err := ioutil.WriteFile(path, []byte{}, 0600); err != nil {
+		return err
+	}
+	return os.Chtimes(path, now, now)
+}
@@ -9,10 +9,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/JSBanya/go-lfile"
 )
 
 // States
@@ -25,21 +25,74 @@ const (
 
 type Server struct {
 	Port     int64
-	Password string
-	Root     string
+	Accounts []*Account
+	Folders  map[string]*FolderEntry
+}
+
+// Session holds the state negotiated for a single client connection
+type Session struct {
+	Account *Account
+	Folder  *FolderEntry // For tenant folders, a copy whose path is the tenant's directory
+	Prefix  string       // Area of the folder the client is confined to, relative to the folder root
+	Tenant  string       // Directory of the tenant within the shared folder, with trailing separator; empty if the folder has no tenants
+	AckKey  string       // Under which changes acknowledged by the client are stored; empty if the client has no journal
+}
+
+var __deleteTimes map[string]map[string]int64 = make(map[string]map[string]int64) // We store delete times per folder to properly handle deletes over several connections and long periods of time
+var __deleteTimesMu sync.Mutex                                                    // Guards __deleteTimes, which the server and all tunnels use
+
+// Get a copy of the delete times for a folder
+func deleteTimes(folderID string) map[string]int64 {
+	__deleteTimesMu.Lock()
+	defer __deleteTimesMu.Unlock()
+
+	times := make(map[string]int64, len(__deleteTimes[folderID]))
+	for relPath, delTime := range __deleteTimes[folderID] {
+		times[relPath] = delTime
+	}
+	return times
+}
 
-	encKey [KEY_SIZE]byte
-	macKey [KEY_SIZE]byte
+// Get the delete time of a path in a folder
+func getDeleteTime(folderID string, relPath string) (int64, bool) {
+	__deleteTimesMu.Lock()
+	defer __deleteTimesMu.Unlock()
+
+	delTime, ok := __deleteTimes[folderID][relPath]
+	return delTime, ok
+}
+
+// Record the delete time of a path in a folder, creating the folder's map if necessary
+func setDeleteTime(folderID string, relPath string, delTime int64) {
+	__deleteTimesMu.Lock()
+	defer __deleteTimesMu.Unlock()
+
+	times, ok := __deleteTimes[folderID]
+	if !ok {
+		times = make(map[string]int64)
+		__deleteTimes[folderID] = times
+	}
+	times[relPath] = delTime
 }
 
-var __deleteTimes map[string]int64 = make(map[string]int64) // We store delete times to properly handle deletes over several connections and long periods of time
+// Forget the delete time of a path in a folder
+func clearDeleteTime(folderID string, relPath string) {
+	__deleteTimesMu.Lock()
+	defer __deleteTimesMu.Unlock()
+
+	delete(__deleteTimes[folderID], relPath)
+}
 
 func (s *Server) Start() error {
 	// Derive keys
-	s.encKey, s.macKey = DeriveKeys(s.Password)
+	for _, account := range s.Accounts {
+		account.encKey, account.macKey = DeriveKeys(account.Password)
+	}
 
-	// Ensure root contains trailing seperator
-	s.Root = strings.TrimSuffix(s.Root, string(os.PathSeparator)) + string(os.PathSeparator)
+	// Ensure folder paths contain trailing seperator
+	for _, folder := range s.Folders {
+		folder.Path = strings.TrimSuffix(folder.Path, string(os.PathSeparator)) + string(os.PathSeparator)
+	}
 
 	// Listen
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", s.Port))
@@ -67,7 +120,8 @@ func (s *Server) Start() error {
 func (s *Server) handleConnection(conn *Connection) {
 	defer conn.Close()
 
-	if err := s.doHandshake(conn); err != nil {
+	account, err := s.doHandshake(conn)
+	if err != nil {
 		log.Printf("[%s] Unable to perform successful handshake: %s", conn.RemoteAddr(), err)
 		return
 	}
@@ -76,59 +130,330 @@ func (s *Server) handleConnection(conn *Connection) {
 	// Setup encrypted connection
 	encConn := &EncryptedConnection{
 		Connection: conn,
-		encKey:     s.encKey,
-		macKey:     s.macKey,
+		encKey:     account.encKey,
+		macKey:     account.macKey,
+	}
+
+	sess, err := s.openSession(encConn, account)
+	if err != nil {
+		log.Printf("[%s] Unable to open session: %s", conn.RemoteAddr(), err)
+		return
 	}
 
 	// Listen for incoming data indefinitely
-	if err := s.handleRequests(encConn); err != nil {
+	if err := s.handleRequests(encConn, sess); err != nil {
 		log.Printf("[%s] Error handling requests: %s", conn.RemoteAddr(), err)
 		return
 	}
 }
 
-func (s *Server) doHandshake(conn *Connection) error {
+// Perform the handshake, identifying the account by its password
+func (s *Server) doHandshake(conn *Connection) (*Account, error) {
 	// Read hello
 	data, err := conn.ReadFull()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if string(data) != "hello" {
-		return errors.New("Bad protocol")
+		return nil, errors.New("Bad protocol")
 	}
 
 	err = conn.WriteFull([]byte("ok"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Read password
 	data, err = conn.ReadFull()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(data) != SALT_SIZE+2+HASH_SIZE {
-		return errors.New("Unexpected protocol (bad size)")
+		return nil, errors.New("Unexpected protocol (bad size)")
 	}
 
 	salt := data[:SALT_SIZE] // Split salt and hash
 
-	expected := SHA256WithPredefinedSalt([]byte(s.Password), salt)
-	if !ConstantTimeCompare(expected, data) { // Compare send and expected hashes
-		return errors.New("Bad password")
+	// Compare against every account so that the time taken does not reveal which one matched
+	var account *Account
+	for _, a := range s.Accounts {
+		expected := SHA256WithPredefinedSalt([]byte(a.Password), salt)
+		if ConstantTimeCompare(expected, data) && account == nil { // Compare send and expected hashes
+			account = a
+		}
+	}
+
+	if account == nil {
+		return nil, errors.New("Bad password")
 	}
 
 	err = conn.WriteFull([]byte("ok"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return account, nil
 }
 
-func (s *Server) handleRequests(conn *EncryptedConnection) error {
+func (s *Server) openSession(conn *EncryptedConnection, account *Account) (*Session, error) {
+	data, err := conn.ReadEncryptedFull()
+	if err != nil {
+		return nil, err
+	}
+
+	var req SessionReq
+	if err = json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+
+	resp := &SessionResp{}
+	folder, ok := s.Folders[req.FolderID]
+	prefix, err := cleanRelPath(req.Prefix)
+
+	// Each account of a tenant folder is confined to its own directory, with its own versions, tombstones and ignore files
+	tenant := ""
+	if ok && folder.Tenants {
+		tenant = account.Name + string(os.PathSeparator)
+		tenantFolder := *folder
+		tenantFolder.Path = folder.Path + tenant
+		folder = &tenantFolder
+	}
+
+	if !ok || !account.HasFolder(req.FolderID) {
+		resp.Error = fmt.Sprintf("Unknown folder %s", req.FolderID)
+	} else if err != nil {
+		resp.Error = err.Error()
+	} else if prefix != "." && !account.HasPrefix(prefix) {
+		resp.Error = fmt.Sprintf("Account %s may not access %s", account.Name, prefix)
+	} else if err = os.MkdirAll(folder.Path+prefix, 0777); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.OK = true
+	}
+
+	if prefix == "." {
+		prefix = ""
+	} else {
+		prefix += string(os.PathSeparator)
+	}
+
+	// Acknowledgements are kept per journal and area, a different prefix receives everything again
+	ackKey := ""
+	if resp.OK && req.JournalID != "" {
+		ackKey = req.JournalID + ":" + filepath.ToSlash(prefix)
+		resp.AckedSeq = LoadAck(folder.Path, ackKey)
+	}
+
+	data, err = json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.WriteEncryptedFull(data); err != nil {
+		return nil, err
+	}
+
+	if !resp.OK {
+		return nil, errors.New(resp.Error)
+	}
+
+	log.Printf("[%s] Opened session for account %s in folder %s (%s)", conn.RemoteAddr(), account.Name, folder.ID, folder.Path+prefix)
+	return &Session{
+		Account: account,
+		Folder:  folder,
+		Prefix:  prefix,
+		Tenant:  tenant,
+		AckKey:  ackKey,
+	}, nil
+}
+
+// Resolve a path sent by the client to a path relative to the folder root and a fully qualified path
+// The path is confined to the area of the folder mapped to the session
+func (sess *Session) resolve(relPath string) (string, string, error) {
+	cleaned, err := cleanRelPath(relPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	if cleaned == "." {
+		return "", "", errors.New("Cannot handle requests on root itself")
+	}
+
+	localPath := sess.Prefix + cleaned
+
+	// Never write through symlinks unless the folder follows them, as they may point outside of the folder
+	if sess.Folder.Symlinks != SYMLINKS_FOLLOW {
+		linked, err := hasSymlinkParent(sess.Folder.Path, localPath)
+		if err != nil {
+			return "", "", err
+		} else if linked {
+			return "", "", fmt.Errorf("Path %s is beneath a symlink", relPath)
+		}
+	} else if len(sess.Account.Paths) > 0 {
+		// Followed symlinks may lead out of the paths of the account
+		realPath, err := evalExisting(sess.Folder.Path + localPath)
+		if err != nil {
+			return "", "", err
+		}
+
+		if within, err := sess.withinAccountPaths(realPath); err != nil {
+			return "", "", err
+		} else if !within {
+			return "", "", fmt.Errorf("Path %s leads outside of the paths of account %s", relPath, sess.Account.Name)
+		}
+	}
+
+	return localPath, sess.Folder.Path + localPath, nil
+}
+
+// Check if a path with resolved symlinks is within the paths of the account
+func (sess *Session) withinAccountPaths(realPath string) (bool, error) {
+	if len(sess.Account.Paths) == 0 {
+		return true, nil
+	}
+
+	realRoot, err := evalExisting(sess.Folder.Path)
+	if err != nil {
+		return false, err
+	}
+
+	if !isWithin(realPath, realRoot) {
+		return false, nil
+	}
+	return sess.Account.HasPath(strings.TrimPrefix(realPath, realRoot+string(os.PathSeparator))), nil
+}
+
+// Stat a local path, only following symlinks if the folder follows them
+func (sess *Session) stat(fqpath string) (os.FileInfo, error) {
+	if sess.Folder.Symlinks == SYMLINKS_FOLLOW {
+		return os.Stat(fqpath)
+	}
+	return os.Lstat(fqpath)
+}
+
+// Get the mode bits that are applied to local files and directories
+func (sess *Session) modeMask() os.FileMode {
+	if sess.Folder.SyncSetuid {
+		return MODE_MASK
+	}
+	return MODE_MASK &^ MODE_SETID
+}
+
+// Check if the mode sent by the client differs from a local file or directory
+func (sess *Session) modeChanged(fi os.FileInfo, mode uint32) bool {
+	if sess.Folder.IgnorePerms || mode == 0 {
+		return false
+	}
+	return fi.Mode()&sess.modeMask() != os.FileMode(mode)&sess.modeMask()
+}
+
+// Apply the mode sent by the client to a local file or directory
+func (sess *Session) applyMode(fqpath string, mode uint32) error {
+	if sess.Folder.IgnorePerms || mode == 0 {
+		return nil
+	}
+	return os.Chmod(fqpath, os.FileMode(mode)&sess.modeMask())
+}
+
+// Get the versioner for files replaced or deleted by the client, or nil if they are not kept
+// Append-only sessions always keep every version, using the folder's versioning type if any
+func (sess *Session) versioner() *Versioner {
+	if !sess.Account.AppendOnly {
+		return NewVersioner(sess.Folder.Path, sess.Folder.Versioning)
+	}
+
+	config := VersioningEntry{Type: VERSIONING_TRASHCAN}
+	if sess.Folder.Versioning != nil && sess.Folder.Versioning.Type != "" {
+		config = *sess.Folder.Versioning
+	}
+
+	return &Versioner{
+		Root:    sess.Folder.Path,
+		Config:  config,
+		NoPrune: true,
+	}
+}
+
+// Check if a file can be received in place of a file of the old size, returning the reason if not
+// The old size is freed once the file is replaced, unless it is kept as a version
+func (sess *Session) checkSpace(localPath string, size int64, freed int64) (string, error) {
+	// Received files are written to the staging directory first
+	dir := sess.Folder.StagingDir
+	if dir == "" {
+		dir = sess.Folder.Path
+	}
+
+	free, err := FreeSpace(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if uint64(size)+MIN_FREE_SPACE > free {
+		return fmt.Sprintf("Not enough free space for %d bytes", size), nil
+	}
+
+	if sess.Folder.Quota > 0 {
+		usage, err := DiskUsage(sess.Folder.Path)
+		if err != nil {
+			return "", err
+		}
+
+		if usage-freed+size > sess.Folder.Quota {
+			return fmt.Sprintf("Quota of %d bytes for folder %s exceeded", sess.Folder.Quota, sess.Folder.ID), nil
+		}
+	}
+
+	if sess.Account.Quota > 0 {
+		usage, err := DiskUsage(sess.Folder.Path + sess.Account.PathOf(localPath))
+		if err != nil {
+			return "", err
+		}
+
+		if usage-freed+size > sess.Account.Quota {
+			return fmt.Sprintf("Quota of %d bytes for account %s exceeded", sess.Account.Quota, sess.Account.Name), nil
+		}
+	}
+
+	return "", nil
+}
+
+// Get the number of bytes freed by replacing a file, which is none if it is kept as a version
+func (sess *Session) freedBy(stat os.FileInfo) int64 {
+	if stat == nil || !stat.Mode().IsRegular() || sess.versioner() != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// Record the delete time of a path so that the delete is passed on to the peers of the folder
+func (sess *Session) recordDelete(localPath string, delTime int64) {
+	setDeleteTime(sess.Folder.ID, sess.Tenant+localPath, delTime)
+}
+
+// Check if the account of the session may perform an operation on a path relative to the folder root
+func (sess *Session) authorize(conn *EncryptedConnection, localPath string, perm string) bool {
+	if sess.Account.Can(perm) && sess.Account.HasPath(localPath) {
+		return true
+	}
+
+	log.Printf("[Local %s] Refuse to %s %s, not permitted for account %s", conn.RemoteAddr(), perm, localPath, sess.Account.Name)
+	return false
+}
+
+// Get the refusal of an operation the account is not permitted to perform
+func (sess *Session) refusal(localPath string, perm string) error {
+	return refusedError{fmt.Errorf("Not permitted to %s %s for account %s", perm, localPath, sess.Account.Name)}
+}
+
+// Record a delete without removing anything, for append-only sessions
+func (sess *Session) tombstone(conn *EncryptedConnection, localPath string, delTime int64) error {
+	log.Printf("[Local %s] Recording delete of %s, keeping data as the session is append-only", conn.RemoteAddr(), localPath)
+	return RecordTombstone(sess.Folder.Path, localPath, delTime)
+}
+
+func (s *Server) handleRequests(conn *EncryptedConnection, sess *Session) error {
 	for {
 		data, err := conn.ReadEncryptedFull() // Block until data is read
 		if err != nil {
@@ -142,59 +467,238 @@ func (s *Server) handleRequests(conn *EncryptedConnection) error {
 			return err
 		}
 
+		if req.FolderID != sess.Folder.ID {
+			return fmt.Errorf("Request for folder %s in session for folder %s", req.FolderID, sess.Folder.ID)
+		}
+
+		var resp *FileInfoResp
+
 		// Check request type
-		switch req.ReqType {
-		case REQ_TYPE_UPDATE:
-			{
-				// Do update
-				if err = s.handleUpdate(conn, &req); err != nil {
-					return err
-				}
+		// Folders that only send ignore changes from peers
+		if req.ReqType == REQ_TYPE_ACK {
+			// Remember how far the client got, so that it only sends newer changes next time
+			if sess.AckKey != "" {
+				err = SaveAck(sess.Folder.Path, sess.AckKey, req.Seq)
 			}
-		case REQ_TYPE_CREATE_DIR:
-			{
-				// Do create
-				if err = s.handleCreateDir(conn, &req); err != nil {
-					return err
+		} else if sess.Folder.Mode == MODE_SEND_ONLY || sess.Folder.Mode == MODE_MIRROR {
+			log.Printf("[Local %s] Ignoring changes to %s, folder %s is %s", conn.RemoteAddr(), req.RelPath, sess.Folder.ID, sess.Folder.Mode)
+		} else {
+			switch req.ReqType {
+			case REQ_TYPE_UPDATE:
+				{
+					// Do update
+					// If the file is requested, the outcome is answered again once it has been received
+					resp, err = s.handleUpdate(conn, sess, &req)
+					if err == nil && resp.SendFile {
+						if err = writeResponse(conn, resp); err != nil {
+							return err
+						}
+						resp = nil
+						err = s.receiveFile(conn, sess, &req)
+					}
 				}
-			}
-		case REQ_TYPE_DELETE:
-			{
-				// Do delete
-				if err = s.handleDelete(conn, &req); err != nil {
-					return err
+			case REQ_TYPE_CREATE_DIR:
+				{
+					// Do create
+					err = s.handleCreateDir(conn, sess, &req)
+				}
+			case REQ_TYPE_DELETE:
+				{
+					// Do delete
+					err = s.handleDelete(conn, sess, &req)
+				}
+			case REQ_TYPE_SYMLINK:
+				{
+					// Do symlink
+					err = s.handleSymlink(conn, sess, &req)
 				}
+			case REQ_TYPE_MIRROR:
+				{
+					// Do mirror
+					resp, err = s.handleMirror(conn, sess, &req)
+				}
+			case REQ_TYPE_FIFO:
+				{
+					// Do FIFO
+					err = s.handleFifo(conn, sess, &req)
+				}
+			default:
+				return errors.New("Unknown request type")
 			}
-		default:
-			return errors.New("Unknown request type")
 		}
+
+		if _, ok := err.(fatalError); ok {
+			return err
+		}
+
+		// Answer every request with its outcome
+		// Errors that only affect this path are sent back so that the client can retry later, and the session stays up
+		if resp == nil {
+			resp = &FileInfoResp{}
+		}
+
+		if refused, ok := err.(refusedError); ok {
+			// Retrying would not help, but the client logs the reason
+			resp.SendFile = false
+			resp.Refused = true
+			resp.Reason = refused.Error()
+		} else if err != nil {
+			log.Printf("[Local %s] Error handling %s: %s", conn.RemoteAddr(), req.RelPath, err)
+			resp.SendFile = false
+			resp.Error = err.Error()
+		}
+
+		if err = writeResponse(conn, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// An error that leaves the connection in an unknown state, ending the session
+type fatalError struct {
+	error
+}
+
+// A request the account is not permitted to make, answered as refused rather than failed
+type refusedError struct {
+	error
+}
+
+// drainWriter passes writes on until one fails, and then discards the rest
+// This allows a transfer to be read to its end even if it cannot be stored, so the connection stays usable
+type drainWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (d *drainWriter) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
 	}
+	return len(p), nil
 }
 
-func (s *Server) handleCreateDir(conn *EncryptedConnection, req *FileInfoReq) error {
+// Check that the contents of a staging file have the hash sent by the client
+func verifyStaging(path string, hash []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum, err := SHA256File(f)
+	if err != nil {
+		return err
+	}
+
+	if !ConstantTimeCompare(sum, hash) {
+		return errors.New("Content hash does not match")
+	}
+	return nil
+}
+
+// Read what the client sends after the contents of a file
+func readTrailer(conn *EncryptedConnection) (*TransferTrailer, error) {
+	data, err := conn.ReadEncryptedFull()
+	if err != nil {
+		return nil, fatalError{err}
+	}
+
+	trailer := &TransferTrailer{}
+	if err = json.Unmarshal(data, trailer); err != nil {
+		return nil, fatalError{err}
+	}
+	return trailer, nil
+}
+
+func writeResponse(conn *EncryptedConnection, resp *FileInfoResp) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteEncryptedFull(data)
+}
+
+// Record a received path if the folder is receive-only, so that local changes can be reverted
+func (sess *Session) recordReceived(localPath string) error {
+	if sess.Folder.Mode != MODE_RECEIVE_ONLY {
+		return nil
+	}
+	return RecordReceived(sess.Folder.Path, localPath)
+}
+
+func (s *Server) handleCreateDir(conn *EncryptedConnection, sess *Session, req *FileInfoReq) error {
 	relPath := req.RelPath
-	fqpath := s.Root + relPath
+	localPath, fqpath, err := sess.resolve(relPath)
+	if err != nil {
+		return err
+	}
 	modTime := time.Unix(0, req.ModTime)
 
-	_, err := os.Stat(fqpath)
+	if ignoreMatcher(sess.Folder.Path).Ignored(localPath, true) {
+		log.Printf("[Local %s] Ignoring create-directory for ignored path %s", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
+	fi, err := os.Stat(fqpath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	} else if err == nil {
-		// Directory already exists
+		if !sess.authorize(conn, localPath, PERM_UPDATE) {
+			return sess.refusal(localPath, PERM_UPDATE)
+		}
+
+		// Directory already exists, only metadata and permissions may have changed
+		// Metadata is applied first as changing ownership may clear mode bits
+		if changed, err := ApplyMetadata(fqpath, req.Meta, &sess.Folder.MetadataOptions); err != nil {
+			return err
+		} else if changed {
+			log.Printf("[Local %s] Changed metadata of directory %s", conn.RemoteAddr(), localPath)
+		}
+
+		if fi, err = os.Stat(fqpath); err != nil {
+			return err
+		}
+
+		if sess.modeChanged(fi, req.Mode) {
+			log.Printf("[Local %s] Changed permissions of directory %s", conn.RemoteAddr(), localPath)
+			return sess.applyMode(fqpath, req.Mode)
+		}
 		return nil
 	}
 
+	if !sess.authorize(conn, localPath, PERM_CREATE) {
+		return sess.refusal(localPath, PERM_CREATE)
+	}
+
 	if err = os.MkdirAll(fqpath, 0777); err != nil {
 		return err
 	}
 
-	log.Printf("[Local %s] Created new directory %s", conn.RemoteAddr(), req.RelPath)
-	return os.Chtimes(fqpath, modTime, modTime)
+	if _, err = ApplyMetadata(fqpath, req.Meta, &sess.Folder.MetadataOptions); err != nil {
+		return err
+	}
+
+	if err = sess.applyMode(fqpath, req.Mode); err != nil {
+		return err
+	}
+
+	if err = os.Chtimes(fqpath, modTime, modTime); err != nil {
+		return err
+	}
+
+	log.Printf("[Local %s] Created new directory %s", conn.RemoteAddr(), localPath)
+	return sess.recordReceived(localPath)
 }
 
-func (s *Server) handleUpdate(conn *EncryptedConnection, req *FileInfoReq) error {
+// Decide whether the file of an update request should be sent
+func (s *Server) handleUpdate(conn *EncryptedConnection, sess *Session, req *FileInfoReq) (*FileInfoResp, error) {
 	relPath := req.RelPath
-	fqpath := s.Root + relPath
+	localPath, fqpath, err := sess.resolve(relPath)
+	if err != nil {
+		return nil, err
+	}
 	modTime := time.Unix(0, req.ModTime)
 
 	resp := &FileInfoResp{}
@@ -202,13 +706,31 @@ func (s *Server) handleUpdate(conn *EncryptedConnection, req *FileInfoReq) error
 
 	// Check if file exists
 	fexists := true
-	stat, err := os.Stat(fqpath)
+	stat, err := sess.stat(fqpath)
 	if err != nil && os.IsNotExist(err) {
 		// File does not exist locally, always request send
 		fexists = false
 		resp.SendFile = true
 	} else if err != nil {
-		return err
+		return nil, err
+	} else if stat.IsDir() {
+		// Refused before the transfer, which could only be discarded
+		log.Printf("[Local %s] Refuse to replace directory %s with file", conn.RemoteAddr(), localPath)
+		resp.Refused = true
+		resp.Reason = fmt.Sprintf("%s is a directory", localPath)
+		return resp, nil
+	}
+
+	perm := PERM_UPDATE
+	if !fexists {
+		perm = PERM_CREATE
+	}
+
+	if !sess.authorize(conn, localPath, perm) {
+		resp.SendFile = false
+		resp.Refused = true
+		resp.Reason = sess.refusal(localPath, perm).Error()
+		return resp, nil
 	}
 
 	// Stat file
@@ -217,115 +739,218 @@ func (s *Server) handleUpdate(conn *EncryptedConnection, req *FileInfoReq) error
 		if stat.ModTime().Before(modTime) {
 			// Local file is older
 			resp.SendFile = true
+		} else if stat.ModTime().Equal(modTime) {
+			// Same content, only metadata and permissions may have changed
+			if changed, err := ApplyMetadata(fqpath, req.Meta, &sess.Folder.MetadataOptions); err != nil {
+				return nil, err
+			} else if changed {
+				log.Printf("[Local %s] Changed metadata of file %s", conn.RemoteAddr(), localPath)
+				if stat, err = os.Stat(fqpath); err != nil {
+					return nil, err
+				}
+			}
+
+			if sess.modeChanged(stat, req.Mode) {
+				log.Printf("[Local %s] Changed permissions of file %s", conn.RemoteAddr(), localPath)
+				if err = sess.applyMode(fqpath, req.Mode); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 
-	// Send response
-	data, err := json.Marshal(resp)
-	if err != nil {
-		return err
+	if resp.SendFile && ignoreMatcher(sess.Folder.Path).Ignored(localPath, false) {
+		// Never write ignored paths
+		log.Printf("[Local %s] Ignoring update for ignored path %s", conn.RemoteAddr(), localPath)
+		resp.SendFile = false
 	}
 
-	if err = conn.WriteEncryptedFull(data); err != nil {
+	if resp.SendFile {
+		// Refuse files that do not fit rather than failing part way through the transfer
+		if resp.Reason, err = sess.checkSpace(localPath, req.Size, sess.freedBy(stat)); err != nil {
+			return nil, err
+		} else if resp.Reason != "" {
+			log.Printf("[Local %s] Refuse update for %s: %s", conn.RemoteAddr(), localPath, resp.Reason)
+			resp.SendFile = false
+			resp.Refused = true
+		}
+	}
+
+	return resp, nil
+}
+
+// Receive the file of an update request after it was requested
+func (s *Server) receiveFile(conn *EncryptedConnection, sess *Session, req *FileInfoReq) error {
+	relPath := req.RelPath
+	modTime := time.Unix(0, req.ModTime)
+
+	// The file is sent regardless of errors here, so it must always be read
+	drain := func(err error) error {
+		if drainErr := conn.ReadEncryptedStream(ioutil.Discard); drainErr != nil {
+			return fatalError{drainErr}
+		}
+
+		if _, drainErr := readTrailer(conn); drainErr != nil {
+			return drainErr
+		}
 		return err
 	}
 
-	if !resp.SendFile {
-		// We requested file not to be sent, so exit
-		return nil
+	localPath, fqpath, err := sess.resolve(relPath)
+	if err != nil {
+		return drain(err)
+	}
+
+	// Never write a file the account may not write, whatever was answered before
+	perm := PERM_UPDATE
+	if _, err = sess.stat(fqpath); os.IsNotExist(err) {
+		perm = PERM_CREATE
+	}
+
+	if !sess.authorize(conn, localPath, perm) {
+		return drain(sess.refusal(localPath, perm))
 	}
 
 	log.Printf("[Local %s] Getting file transfer for %s", conn.RemoteAddr(), relPath)
 
-	// Create a temporary file to write to so that we don't overwrite old file if transfer fails
-	// Writing to a temporary file also avoids deadlocks caused by immediately write-locking the file
-	// The temporary file will be "revoled" to the real file later whenever a lock can be aquired
-	tempFile, err := ioutil.TempFile("", "")
+	// Write to a staging file on the same filesystem so that the old file is not overwritten if the transfer fails
+	// The staging file is then renamed over the old file, so readers only ever see the old or the new version
+	// Parent directories may be missing when only part of the sender's tree is synchronized
+	if err = os.MkdirAll(filepath.Dir(fqpath), 0777); err != nil {
+		return drain(err)
+	}
+
+	stagingDir := sess.Folder.StagingDir
+	if stagingDir == "" {
+		stagingDir = filepath.Dir(fqpath)
+	}
+
+	staging, err := CreateStagingFile(stagingDir)
 	if err != nil {
-		return err
+		return drain(err)
 	}
 	defer func() {
-		tempFile.Close()
-		os.Remove(tempFile.Name())
+		staging.Close()
+		os.Remove(staging.Name()) // No-op once renamed
 	}()
 
 	// Begin reading file
-	if err = conn.ReadEncryptedStream(tempFile); err != nil {
+	// A failed write, for example on a full disk, does not stop the rest of the file from being read
+	w := &drainWriter{w: staging}
+	if err = conn.ReadEncryptedStream(w); err != nil {
+		return fatalError{err}
+	}
+
+	trailer, err := readTrailer(conn)
+	if err != nil {
 		return err
 	}
 
-	if _, err := tempFile.Seek(0, 0); err != nil {
+	if w.err != nil {
+		return w.err
+	}
+
+	// The sender retries files that changed while they were sent
+	if !trailer.Valid {
+		log.Printf("[Local %s] Discarding %s, file changed while it was sent", conn.RemoteAddr(), localPath)
+		return errors.New("File changed while it was sent")
+	}
+
+	if err = staging.Sync(); err != nil {
 		return err
 	}
 
-	// File transfer successful, swap old file with temp file
-	// This is done as soon as we can get a lock
+	// Verify what was stored rather than what was received
+	if err = verifyStaging(staging.Name(), trailer.Hash); err != nil {
+		log.Printf("[Local %s] Discarding %s: %s", conn.RemoteAddr(), localPath, err)
+		return err
+	}
 
-	// Open file and create if not exists
-	var f *os.File
-	stat, err = os.Stat(fqpath)
-	if err != nil && os.IsNotExist(err) {
-		// File still does not exist, so we can safely create and lock it
-		f, err = os.Create(fqpath)
-		if err != nil {
-			return err
-		}
-	} else if err != nil {
+	if err = staging.Close(); err != nil {
+		return err
+	}
+
+	// File transfer successful, check that the old file was not updated in the meantime
+	stat, err := sess.stat(fqpath)
+	if err != nil && !os.IsNotExist(err) {
 		// Unhandled stat error
 		return err
-	} else {
-		// File exists
+	} else if err == nil {
 		if !stat.ModTime().Before(modTime) {
 			// Local file is now newer, exit
 			log.Printf("[Local %s] Refuse to resolve %s, file updated locally.", conn.RemoteAddr(), relPath)
 			return nil // Silent exit
-		} else {
-			// Open the existing file
-			f, err = os.OpenFile(fqpath, os.O_RDWR, 0666)
-			if err != nil {
+		}
+
+		if stat.IsDir() {
+			log.Printf("[Local %s] Refuse to replace directory %s with file", conn.RemoteAddr(), localPath)
+			return nil
+		}
+
+		if sess.Folder.Symlinks == SYMLINKS_FOLLOW {
+			// Replace the file the symlink points to rather than the symlink
+			if fqpath, err = filepath.EvalSymlinks(fqpath); err != nil {
+				return err
+			}
+		}
+
+		// Keep the permissions of the old file unless they are replicated
+		if stat.Mode().IsRegular() {
+			if err = os.Chmod(staging.Name(), stat.Mode()&sess.modeMask()); err != nil {
 				return err
 			}
 		}
 	}
 
-	// Lock file
-	lf := lfile.New(f)
-	defer func() {
-		log.Printf("[Local %s] Unlocking %s...", conn.RemoteAddr(), relPath)
-		lf.UnlockAndClose()
-		log.Printf("[Local %s] Unlocked %s", conn.RemoteAddr(), relPath)
-	}()
+	// Give the staging file its final metadata, permissions and mod-time before it is put in place
+	if _, err = ApplyMetadata(staging.Name(), req.Meta, &sess.Folder.MetadataOptions); err != nil {
+		return err
+	}
 
-	log.Printf("[Local %s] Locking %s to resolve transfer...", conn.RemoteAddr(), relPath)
-	err = lf.RWLock()
-	if err != nil {
+	if err = sess.applyMode(staging.Name(), req.Mode); err != nil {
 		return err
 	}
-	log.Printf("[Local %s] Locked %s", conn.RemoteAddr(), relPath)
 
-	// Resolve file
-	if err = lf.Truncate(0); err != nil {
+	if err = os.Chtimes(staging.Name(), modTime, modTime); err != nil {
 		return err
 	}
 
-	if _, err = io.Copy(lf, tempFile); err != nil {
+	received, err := os.Stat(staging.Name())
+	if err != nil {
 		return err
 	}
+	freed := sess.freedBy(stat)
 
-	if err = os.Chtimes(fqpath, modTime, modTime); err != nil {
+	// Keep the old file if versioning is enabled
+	if versioner := sess.versioner(); versioner != nil && stat != nil {
+		if err = versioner.Keep(localPath); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(staging.Name(), fqpath); err != nil {
 		return err
 	}
 
-	log.Printf("[Local %s] Updated file %s", conn.RemoteAddr(), relPath)
-	return nil
+	if err = SyncDir(filepath.Dir(fqpath)); err != nil {
+		return err
+	}
+	AdjustUsage(fqpath, received.Size()-freed)
+
+	log.Printf("[Local %s] Updated file %s", conn.RemoteAddr(), localPath)
+	return sess.recordReceived(localPath)
 }
 
-func (s *Server) handleDelete(conn *EncryptedConnection, req *FileInfoReq) error {
+func (s *Server) handleDelete(conn *EncryptedConnection, sess *Session, req *FileInfoReq) error {
 	relPath := req.RelPath
-	fqpath := s.Root + relPath
+	localPath, fqpath, err := sess.resolve(relPath)
+	if err != nil {
+		return err
+	}
 	delTime := time.Unix(0, req.DelTime)
+	ignore := ignoreMatcher(sess.Folder.Path)
 
-	fi, err := os.Stat(fqpath)
+	fi, err := os.Lstat(fqpath)
 	if err != nil && os.IsNotExist(err) {
 		// File already deleted
 		return nil
@@ -333,14 +958,238 @@ func (s *Server) handleDelete(conn *EncryptedConnection, req *FileInfoReq) error
 		return err
 	}
 
+	if ignore.Ignored(localPath, fi.IsDir()) {
+		// Never delete ignored paths
+		log.Printf("[Local %s] Ignoring delete for ignored path %s", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
 	// Check mod time
 	if !fi.ModTime().Before(delTime) {
 		// Delete is not the most recent op, ignore
 		return nil
 	}
 
-	// Delete is most recent; do delete
-	log.Printf("[Local %s] Deleting file %s", conn.RemoteAddr(), relPath)
-	__deleteTimes[relPath] = req.DelTime
-	return os.RemoveAll(fqpath)
+	if !sess.authorize(conn, localPath, PERM_DELETE) {
+		return sess.refusal(localPath, PERM_DELETE)
+	}
+
+	// Delete is most recent
+	// Append-only deletes are not added to the delete times, so they are never passed on to other peers
+	if sess.Account.AppendOnly {
+		return sess.tombstone(conn, localPath, req.DelTime)
+	}
+
+	// Do delete
+	log.Printf("[Local %s] Deleting file %s", conn.RemoteAddr(), localPath)
+	sess.recordDelete(localPath, req.DelTime)
+	err = RemoveUnignored(sess.Folder.Path, localPath, ignore, sess.versioner()) // Ignored paths within deleted directories are kept
+	InvalidateUsage(fqpath)
+	if err != nil {
+		return err
+	}
+
+	return sess.recordReceived(localPath)
+}
+
+func (s *Server) handleSymlink(conn *EncryptedConnection, sess *Session, req *FileInfoReq) error {
+	relPath := req.RelPath
+	localPath, fqpath, err := sess.resolve(relPath)
+	if err != nil {
+		return err
+	}
+	modTime := time.Unix(0, req.ModTime)
+	target := filepath.FromSlash(req.LinkTarget)
+
+	if sess.Folder.Symlinks == SYMLINKS_SKIP {
+		log.Printf("[Local %s] Ignoring symlink %s, symlinks are skipped", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
+	if ignoreMatcher(sess.Folder.Path).Ignored(localPath, false) {
+		log.Printf("[Local %s] Ignoring symlink for ignored path %s", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
+	// Refuse targets that escape the area of the folder mapped to the session
+	if filepath.IsAbs(target) {
+		log.Printf("[Local %s] Refuse symlink %s, absolute target %s", conn.RemoteAddr(), localPath, target)
+		return nil
+	}
+
+	if _, err = cleanRelPath(filepath.Join(filepath.Dir(filepath.FromSlash(relPath)), target)); err != nil {
+		log.Printf("[Local %s] Refuse symlink %s, target %s escapes folder", conn.RemoteAddr(), localPath, target)
+		return refusedError{fmt.Errorf("Symlink target %s escapes folder", target)}
+	}
+
+	// Symlinks the target passes through may lead elsewhere than its path suggests
+	if escapes, err := symlinkEscapes(sess.Folder.Path+sess.Prefix, filepath.Dir(fqpath), target); err != nil || escapes {
+		log.Printf("[Local %s] Refuse symlink %s, target %s escapes folder", conn.RemoteAddr(), localPath, target)
+		return refusedError{fmt.Errorf("Symlink target %s escapes folder", target)}
+	}
+
+	// Nor may accounts link to paths they have no access to
+	if realTarget, ok, err := resolveSymlinkTarget(filepath.Dir(fqpath), target); err != nil || !ok {
+		log.Printf("[Local %s] Refuse symlink %s, target %s escapes folder", conn.RemoteAddr(), localPath, target)
+		return nil
+	} else if within, err := sess.withinAccountPaths(realTarget); err != nil || !within {
+		log.Printf("[Local %s] Refuse symlink %s, target %s is outside of the paths of account %s", conn.RemoteAddr(), localPath, target, sess.Account.Name)
+		return refusedError{fmt.Errorf("Symlink target %s is outside of the paths of account %s", target, sess.Account.Name)}
+	}
+
+	fi, err := os.Lstat(fqpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if existing, err := os.Readlink(fqpath); err == nil && existing == target {
+				// Link already exists
+				return nil
+			}
+		}
+
+		if !fi.ModTime().Before(modTime) {
+			// Local path is newer
+			return nil
+		}
+
+		if fi.IsDir() {
+			log.Printf("[Local %s] Refuse to replace directory %s with symlink", conn.RemoteAddr(), localPath)
+			return nil
+		}
+
+		if !sess.authorize(conn, localPath, PERM_UPDATE) {
+			return sess.refusal(localPath, PERM_UPDATE)
+		}
+
+		if versioner := sess.versioner(); versioner != nil {
+			err = versioner.Move(localPath)
+		} else {
+			err = os.Remove(fqpath)
+		}
+		InvalidateUsage(fqpath)
+
+		if err != nil {
+			return err
+		}
+	} else if !sess.authorize(conn, localPath, PERM_CREATE) {
+		return sess.refusal(localPath, PERM_CREATE)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fqpath), 0777); err != nil {
+		return err
+	}
+
+	if err = os.Symlink(target, fqpath); err != nil {
+		return err
+	}
+
+	log.Printf("[Local %s] Created symlink %s -> %s", conn.RemoteAddr(), localPath, target)
+	return sess.recordReceived(localPath)
+}
+
+func (s *Server) handleFifo(conn *EncryptedConnection, sess *Session, req *FileInfoReq) error {
+	localPath, fqpath, err := sess.resolve(req.RelPath)
+	if err != nil {
+		return err
+	}
+	modTime := time.Unix(0, req.ModTime)
+
+	if sess.Folder.SpecialFiles != SPECIALS_METADATA {
+		log.Printf("[Local %s] Ignoring FIFO %s, special files are skipped", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
+	if ignoreMatcher(sess.Folder.Path).Ignored(localPath, false) {
+		log.Printf("[Local %s] Ignoring FIFO for ignored path %s", conn.RemoteAddr(), localPath)
+		return nil
+	}
+
+	fi, err := os.Lstat(fqpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if fi.Mode()&os.ModeNamedPipe != 0 {
+			// FIFO already exists, only its mode may differ
+			if !sess.modeChanged(fi, req.Mode) {
+				return nil
+			} else if !sess.authorize(conn, localPath, PERM_UPDATE) {
+				return sess.refusal(localPath, PERM_UPDATE)
+			}
+			return sess.applyMode(fqpath, req.Mode)
+		}
+
+		if !fi.ModTime().Before(modTime) {
+			// Local path is newer
+			return nil
+		}
+
+		if fi.IsDir() {
+			log.Printf("[Local %s] Refuse to replace directory %s with FIFO", conn.RemoteAddr(), localPath)
+			return nil
+		}
+
+		if !sess.authorize(conn, localPath, PERM_UPDATE) {
+			return sess.refusal(localPath, PERM_UPDATE)
+		}
+
+		if versioner := sess.versioner(); versioner != nil {
+			err = versioner.Move(localPath)
+		} else {
+			err = os.Remove(fqpath)
+		}
+		InvalidateUsage(fqpath)
+
+		if err != nil {
+			return err
+		}
+	} else if !sess.authorize(conn, localPath, PERM_CREATE) {
+		return sess.refusal(localPath, PERM_CREATE)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(fqpath), 0777); err != nil {
+		return err
+	}
+
+	if err = Mkfifo(fqpath, 0666); err != nil {
+		return err
+	}
+
+	if err = sess.applyMode(fqpath, req.Mode); err != nil {
+		return err
+	}
+
+	if err = os.Chtimes(fqpath, modTime, modTime); err != nil {
+		return err
+	}
+
+	log.Printf("[Local %s] Created FIFO %s", conn.RemoteAddr(), localPath)
+	return sess.recordReceived(localPath)
+}
+
+// List the paths the mirroring peer does not have, which it then deletes like any other path
+// The peer decides, so that its selection, ignore files and delete limits apply
+func (s *Server) handleMirror(conn *EncryptedConnection, sess *Session, req *FileInfoReq) (*FileInfoResp, error) {
+	log.Printf("[Local %s] Mirroring %d paths", conn.RemoteAddr(), len(req.Paths))
+
+	// Mirroring compares the contents of the folder, which the account must be allowed to see
+	if !sess.Account.Can(PERM_READ) {
+		log.Printf("[Local %s] Refuse to mirror, not permitted for account %s", conn.RemoteAddr(), sess.Account.Name)
+		return nil, nil
+	}
+
+	unlisted, err := UnlistedPaths(sess.Folder.Path, sess.Prefix, req.Paths, ignoreMatcher(sess.Folder.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &FileInfoResp{Paths: []string{}}
+	for _, localPath := range unlisted {
+		if !sess.Account.HasPath(localPath) {
+			continue // Outside of the account's paths, so not part of the mirror
+		}
+		resp.Paths = append(resp.Paths, filepath.ToSlash(strings.TrimPrefix(localPath, sess.Prefix)))
+	}
+
+	return resp, nil
 }
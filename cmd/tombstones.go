@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Log of deletes received from append-only peers, whose data is kept
+const TOMBSTONES_FILE = INTERNAL_PREFIX + string(os.PathSeparator) + "tombstones"
+
+type Tombstone struct {
+	RelPath string `json:"relPath"`
+	DelTime int64  `json:"delTime"`
+}
+
+var __tombstonesLock sync.Mutex
+
+// Append a tombstone for a path that was deleted by a peer but kept locally
+func RecordTombstone(root string, relPath string, delTime int64) error {
+	data, err := json.Marshal(&Tombstone{
+		RelPath: relPath,
+		DelTime: delTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	__tombstonesLock.Lock()
+	defer __tombstonesLock.Unlock()
+
+	if err = os.MkdirAll(filepath.Join(root, INTERNAL_PREFIX), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(root, TOMBSTONES_FILE), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -19,10 +21,28 @@ type Tunnel struct {
 	IP       string
 	Port     int64
 	Password string
+	FolderID string
 	Root     string
 
+	RemotePrefix string
+	Include      []string
+	Exclude      []string
+	Symlinks     string
+	IgnorePerms  bool
+	Metadata     MetadataOptions
+	DeleteGuard  *DeleteGuard
+	Mirror       bool   // Delete everything on the peer that does not exist locally
+	Specials     string // One of "skip" or "metadata"
+	Journal      *Journal
+	Watcher      *FolderWatcher
+
 	conn    *Connection
 	encConn *EncryptedConnection
+	ignore  *IgnoreMatcher
+
+	releasedDeletes int        // Last release counter seen from the delete guard
+	queue           *PeerQueue // Changes the peer has not received yet
+	acked           int64      // Last journal sequence number acknowledged by the peer
 
 	passwordHash []byte
 	encKey       [KEY_SIZE]byte
@@ -34,20 +54,64 @@ const (
 	REQ_TYPE_CREATE_DIR = iota
 	REQ_TYPE_UPDATE
 	REQ_TYPE_DELETE
+	REQ_TYPE_SYMLINK
+	REQ_TYPE_MIRROR
+	REQ_TYPE_ACK
+	REQ_TYPE_FIFO
 )
 
+type SessionReq struct {
+	FolderID  string `json:"folderID"`
+	Prefix    string `json:"prefix"`
+	JournalID string `json:"journalID,omitempty"` // Identifies the sender's journal, so that acknowledged changes are not sent again
+}
+
+type SessionResp struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error"`
+	AckedSeq int64  `json:"ackedSeq"` // Last journal sequence number acknowledged for the sender's journal
+}
+
 type FileInfoReq struct {
-	ReqType int
-	RelPath string `json:"relPath"`
-	ModTime int64  `json:"modTime"`
-	DelTime int64  `json:"delTime"`
+	ReqType  int
+	FolderID string `json:"folderID"`
+	RelPath  string `json:"relPath"`
+	ModTime  int64  `json:"modTime"`
+	DelTime  int64  `json:"delTime"`
+	Size     int64  `json:"size"` // Size of the file for updates
+
+	Mode       uint32        `json:"mode"`           // Permission bits of files and directories; zero if not replicated
+	LinkTarget string        `json:"linkTarget"`     // Target of a symlink, using "/" as the separator
+	Meta       *FileMetadata `json:"meta,omitempty"` // Extended attributes and ownership, if replicated
+
+	Paths []string `json:"paths,omitempty"` // All paths that exist locally, for mirror requests
+	Seq   int64    `json:"seq,omitempty"`   // Last journal sequence number the peer has handled, for ack requests
 }
 
 type FileInfoResp struct {
-	PingOK   bool `json:"pingOK"`
-	SendFile bool `json:"sendFile"`
+	PingOK   bool     `json:"pingOK"`
+	SendFile bool     `json:"sendFile"`
+	Refused  bool     `json:"refused"` // The file is not wanted, for example because there is not enough space
+	Reason   string   `json:"reason"`
+	Error    string   `json:"error"`           // The request failed for this path only and may be retried
+	Paths    []string `json:"paths,omitempty"` // Paths the peer has that were not listed in a mirror request
 }
 
+// Sent after the contents of a file
+type TransferTrailer struct {
+	Valid bool   `json:"valid"` // False if the file changed while it was sent, in which case it must be discarded
+	Hash  []byte `json:"hash"`  // SHA-256 of the contents that were sent
+}
+
+// Delays before retrying a path that failed, doubling with each attempt
+const (
+	RETRY_MIN_DELAY = 10 * time.Second
+	RETRY_MAX_DELAY = 10 * time.Minute
+)
+
+// Returned for deletes held back by the delete guard, which stay queued until they are confirmed
+var errDeleteHeld = errors.New("Delete held back until confirmed")
+
 // Start the connection to peer
 func (t *Tunnel) Setup() error {
 	// Create password hash
@@ -62,6 +126,14 @@ func (t *Tunnel) Setup() error {
 
 	// Ensure root contains trailing seperator
 	t.Root = strings.TrimSuffix(t.Root, string(os.PathSeparator)) + string(os.PathSeparator)
+	t.ignore = ignoreMatcher(t.Root)
+
+	// Changes are queued while the peer is offline
+	t.queue, err = OpenPeerQueue(t.Root, fmt.Sprintf("%s:%d/%s", t.IP, t.Port, filepath.ToSlash(t.RemotePrefix)), t.Journal)
+	if err != nil {
+		return err
+	}
+	go t.queue.Run()
 
 	return nil
 }
@@ -159,30 +231,94 @@ func (t *Tunnel) doHandshake() error {
 		return errors.New("Bad protocol.")
 	}
 
+	// Select folder
+	sessData, err := json.Marshal(&SessionReq{
+		FolderID:  t.FolderID,
+		Prefix:    filepath.ToSlash(t.RemotePrefix),
+		JournalID: t.Journal.ID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = t.encConn.WriteEncryptedFull(sessData); err != nil {
+		return err
+	}
+
+	respData, err := t.encConn.ReadEncryptedFull()
+	if err != nil {
+		return err
+	}
+
+	var resp SessionResp
+	if err = json.Unmarshal(respData, &resp); err != nil {
+		return err
+	}
+
+	if !resp.OK {
+		return fmt.Errorf("Peer refused folder %s: %s", t.FolderID, resp.Error)
+	}
+
+	t.acked = resp.AckedSeq
 	return nil
 }
 
 func (t *Tunnel) Watch() error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
+	// Never send anything from a folder without a marker, it may be unmounted
+	if !HasMarker(t.Root) {
+		return fmt.Errorf("Folder marker %s is missing, refusing to synchronize %s", MARKER_FILE, t.Root)
+	}
+
+	t.releasedDeletes = t.DeleteGuard.CheckConfirmed(t.FolderID)
+
+	// Only send what is queued, unless changes were lost or the peer lost what it acknowledged
+	if t.queue.NeedsResync() || t.acked < t.queue.Acked() {
+		if err := t.fullSync(); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("[Remote %v:%v] Sending %d queued changes", t.IP, t.Port, t.queue.Depth())
+	}
+
+	// Remove everything on the peer that does not exist locally, as the peer may have changed while disconnected
+	if t.Mirror {
+		items, _, err := t.Watcher.Snapshot()
+		if err != nil {
+			return err
+		}
+
+		if err = t.sendMirror(items); err != nil {
+			return err
+		}
+	}
+
+	if err := t.drain(); err != nil {
 		return err
 	}
-	defer watcher.Close()
 
-	if err = watcher.Add(t.Root); err != nil {
+	if err := t.sendAck(); err != nil {
 		return err
 	}
 
-	// Do initial sync
-	// Get current files and directories
-	files, dirs, err := ListItems(t.Root, "")
+	// Handle future changes
+	return t.WatchHandler()
+}
+
+// Synchronize every path in the folder
+func (t *Tunnel) fullSync() error {
+	log.Printf("[Remote %v:%v] Synchronizing all files", t.IP, t.Port)
+
+	// Queued changes up to the scan are covered by it
+	// The scan is shared with the other peers of the folder
+	t.queue.StartResync()
+	t.ignore.Reset()
+	items, seq, err := t.Watcher.Snapshot()
 	if err != nil {
 		return err
 	}
 
-	// Add all dirs to watcher
 	// Create artificial watcher events to sync each directory
-	for _, d := range dirs {
+	for _, d := range items.Dirs {
 		e := fsnotify.Event{
 			Name: t.Root + d,
 			Op:   fsnotify.Create,
@@ -190,72 +326,314 @@ func (t *Tunnel) Watch() error {
 
 		log.Printf("[Remote %v:%v] Synchronizing directory %s", t.IP, t.Port, e.Name)
 
-		if err = t.handleEvent(e, watcher); err != nil { // Directory will be added to watcher automatically on create events
+		if err = t.processEvent(e, seq); err != nil {
 			return err
 		}
 	}
 
 	// Create artificial watcher events to delete old files
-	for relPath, _ := range __deleteTimes {
+	if err = t.sendHistoricDeletes(); err != nil {
+		return err
+	}
+
+	// Create artificial watcher events to sync each file
+	for _, f := range items.Files {
 		e := fsnotify.Event{
-			Name: t.Root + relPath,
-			Op:   fsnotify.Remove,
+			Name: t.Root + f,
+			Op:   fsnotify.Write,
 		}
 
-		log.Printf("[Remote %v:%v] Removing historic file %s", t.IP, t.Port, e.Name)
+		log.Printf("[Remote %v:%v] Synchronizing file %s", t.IP, t.Port, e.Name)
 
-		if err = t.handleEvent(e, watcher); err != nil {
+		if err = t.processEvent(e, seq); err != nil {
 			return err
 		}
 	}
 
-	// Create artificial watcher events to sync each file
-	for _, f := range files {
+	// Create artificial watcher events to sync each symlink
+	for _, l := range items.Links {
 		e := fsnotify.Event{
-			Name: t.Root + f,
-			Op:   fsnotify.Write,
+			Name: t.Root + l,
+			Op:   fsnotify.Create,
 		}
 
-		log.Printf("[Remote %v:%v] Synchronizing file %s", t.IP, t.Port, e.Name)
+		log.Printf("[Remote %v:%v] Synchronizing symlink %s", t.IP, t.Port, e.Name)
 
-		if err = t.handleEvent(e, watcher); err != nil {
+		if err = t.processEvent(e, seq); err != nil {
 			return err
 		}
 	}
 
-	// Handle future events
-	done := make(chan error)
-	go t.WatchHandler(watcher, done)
+	// Create artificial watcher events to sync each special file
+	for _, p := range items.Specials {
+		e := fsnotify.Event{
+			Name: t.Root + p,
+			Op:   fsnotify.Create,
+		}
+
+		if err = t.processEvent(e, seq); err != nil {
+			return err
+		}
+	}
 
-	return <-done
+	return nil
 }
 
-func (t *Tunnel) WatchHandler(watcher *fsnotify.Watcher, done chan error) {
+// Send the queued changes that are due
+func (t *Tunnel) drain() error {
+	for _, relPath := range t.queue.Due() {
+		item, ok := t.queue.Get(relPath)
+		if !ok {
+			continue
+		}
+
+		if item.Attempts > 0 {
+			log.Printf("[Remote %v:%v] Retrying %s (attempt %d)", t.IP, t.Port, relPath, item.Attempts+1)
+		}
+
+		e := fsnotify.Event{
+			Name: t.Root + relPath,
+			Op:   item.Op,
+		}
+
+		if err := t.processEvent(e, item.Seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Acknowledge every change that was sent, up to the first one that is still queued
+func (t *Tunnel) sendAck() error {
+	seq, ok := t.queue.Delivered()
+	if !ok {
+		return nil
+	}
+
+	if durable := t.Journal.Durable(); durable < seq {
+		seq = durable
+	}
+
+	if seq <= t.acked {
+		return nil
+	}
+
+	req := &FileInfoReq{
+		ReqType:  REQ_TYPE_ACK,
+		FolderID: t.FolderID,
+		Seq:      seq,
+	}
+
+	// Acknowledged again later if the peer was unable to store it
+	if _, err := t.request(req); err != nil {
+		if _, ok := err.(fatalError); ok {
+			return err
+		}
+		log.Printf("[Remote %v:%v] Error acknowledging changes up to %d: %s", t.IP, t.Port, seq, err)
+		return nil
+	}
+
+	t.acked = seq
+	t.queue.SetAcked(seq)
+	return nil
+}
+
+// Send all selected local paths so that the peer removes everything else
+func (t *Tunnel) sendMirror(items *ScanResult) error {
+	paths := []string{}
+	lists := [][]string{items.Files, items.Dirs, items.Links}
+	if t.Specials == SPECIALS_METADATA {
+		lists = append(lists, items.Specials)
+	}
+
+	for _, list := range lists {
+		for _, relPath := range list {
+			if t.isSelected(relPath) {
+				paths = append(paths, filepath.ToSlash(relPath))
+			}
+		}
+	}
+
+	log.Printf("[Remote %v:%v] Mirroring %d paths", t.IP, t.Port, len(paths))
+	req := &FileInfoReq{
+		ReqType:  REQ_TYPE_MIRROR,
+		FolderID: t.FolderID,
+		Paths:    paths,
+	}
+
+	resp, err := t.request(req)
+	if err != nil {
+		if _, ok := err.(fatalError); ok {
+			return err
+		}
+		log.Printf("[Remote %v:%v] Error mirroring: %s", t.IP, t.Port, err) // Mirrored again on the next connection
+		return nil
+	}
+
+	// Paths that are not selected or ignored here are not part of the mirror, and neither are the directories containing them
+	remove := []string{}
+	kept := []string{}
+	for _, p := range resp.Paths {
+		relPath, err := cleanRelPath(p)
+		if err != nil || relPath == "." {
+			continue
+		}
+
+		if !t.isSelected(relPath) || t.ignore.Ignored(relPath, false) || t.ignore.Ignored(relPath, true) {
+			kept = append(kept, relPath)
+		} else {
+			remove = append(remove, relPath)
+		}
+	}
+
+	// Deleted like any other path, so that the delete limits apply
+	removed := []string{}
+	for _, relPath := range remove {
+		if isBeneath(relPath, removed) || containsAny(relPath, kept) {
+			continue
+		}
+
+		log.Printf("[Remote %v:%v] Deleting %s, not in mirrored folder", t.IP, t.Port, relPath)
+		e := fsnotify.Event{
+			Name: t.Root + relPath,
+			Op:   fsnotify.Remove,
+		}
+
+		if err = t.processEvent(e, 0); err != nil {
+			return err
+		}
+		removed = append(removed, relPath)
+	}
+	return nil
+}
+
+// Check if any of a list of paths is beneath a directory
+func containsAny(dir string, paths []string) bool {
+	for _, p := range paths {
+		if isBeneath(p, []string{dir}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send deletes for all paths with a recorded delete time
+func (t *Tunnel) sendHistoricDeletes() error {
+	for relPath, _ := range deleteTimes(t.FolderID) {
+		e := fsnotify.Event{
+			Name: t.Root + relPath,
+			Op:   fsnotify.Remove,
+		}
+
+		log.Printf("[Remote %v:%v] Removing historic file %s", t.IP, t.Port, e.Name)
+
+		// Never supersedes a queued change
+		if err := t.processEvent(e, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send changes as they are queued
+func (t *Tunnel) WatchHandler() error {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	// Catch up with changes queued while synchronizing
+	select {
+	case t.queue.Changes <- struct{}{}:
+	default:
+	}
+
 	for {
 		select {
-		case event, ok := <-watcher.Events:
-			{
-				if !ok {
-					done <- errors.New("Watcher failed for unknown reason.")
-					return
+		case <-ticker.C:
+			// Send held back deletes once they are confirmed
+			if released := t.DeleteGuard.CheckConfirmed(t.FolderID); released != t.releasedDeletes {
+				t.releasedDeletes = released
+				if err := t.sendHistoricDeletes(); err != nil {
+					return err
 				}
+			}
+
+			// Retry failed paths
+			if err := t.drain(); err != nil {
+				return err
+			}
 
-				err := t.handleEvent(event, watcher)
-				if err != nil {
-					done <- err
-					return
+			if err := t.sendAck(); err != nil {
+				return err
+			}
+		case <-t.queue.Changes:
+			if t.queue.NeedsResync() {
+				// Changes were lost
+				if err := t.fullSync(); err != nil {
+					return err
 				}
 			}
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				done <- errors.New(fmt.Sprintf("Watcher failed: %s", err))
-				return
+
+			if err := t.drain(); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (t *Tunnel) handleEvent(e fsnotify.Event, watcher *fsnotify.Watcher) error {
+// Handle an event, keeping it queued to be retried later if it failed for this path only
+// Only errors that affect the whole connection are returned
+func (t *Tunnel) processEvent(e fsnotify.Event, seq int64) error {
+	relPath := strings.TrimPrefix(e.Name, t.Root)
+	err := t.handleEvent(e)
+	if err == nil {
+		t.queue.Done(relPath, seq)
+		return nil
+	} else if err == errDeleteHeld {
+		t.queue.Hold(relPath, e.Op, seq, RETRY_MIN_DELAY)
+		return nil
+	} else if _, ok := err.(fatalError); ok {
+		return err
+	}
+
+	delay := t.queue.Fail(relPath, e.Op, seq)
+	log.Printf("[Remote %v:%v] Error synchronizing %s, retrying in %s: %s", t.IP, t.Port, e.Name, delay, err)
+	return nil
+}
+
+// Send a request to the peer and wait for its outcome
+// Failures of the connection are fatal, while errors reported by the peer only affect the path of the request
+func (t *Tunnel) request(req *FileInfoReq) (*FileInfoResp, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.encConn.WriteEncryptedFull(data); err != nil {
+		return nil, fatalError{err}
+	}
+
+	return t.readResponse()
+}
+
+// Read the response to a request
+func (t *Tunnel) readResponse() (*FileInfoResp, error) {
+	data, err := t.encConn.ReadEncryptedFull()
+	if err != nil {
+		return nil, fatalError{err}
+	}
+
+	resp := &FileInfoResp{}
+	if err = json.Unmarshal(data, resp); err != nil {
+		return nil, fatalError{err}
+	}
+
+	if resp.Error != "" {
+		return resp, fmt.Errorf("Peer failed: %s", resp.Error)
+	}
+	return resp, nil
+}
+
+func (t *Tunnel) handleEvent(e fsnotify.Event) error {
 	fullPath := e.Name
 	relPath := strings.TrimPrefix(e.Name, t.Root)
 	if relPath == fullPath {
@@ -273,28 +651,119 @@ func (t *Tunnel) handleEvent(e fsnotify.Event, watcher *fsnotify.Watcher) error
 		return nil
 	}
 
+	if !HasMarker(t.Root) {
+		return fatalError{fmt.Errorf("Folder marker %s is missing, refusing to synchronize %s", MARKER_FILE, t.Root)}
+	}
+
+	// Reload ignore files when they change
+	if filepath.Base(relPath) == IGNORE_FILE {
+		t.ignore.Invalidate(filepath.Dir(relPath))
+	}
+
+	// Check for symlinks
+	fi, err := os.Lstat(fullPath)
+	isLink := err == nil && fi.Mode()&os.ModeSymlink != 0
+	if isLink && t.Symlinks == SYMLINKS_SKIP {
+		return nil
+	} else if isLink && t.Symlinks == SYMLINKS_FOLLOW {
+		if fi, err = os.Stat(fullPath); err != nil {
+			// Broken link, nothing to follow
+			return nil
+		}
+		isLink = false
+	}
+
+	// Ignored paths are never sent or watched
+	// Paths that no longer exist are ignored if they would be ignored as either a file or a directory
+	if (err == nil && t.ignore.Ignored(relPath, fi.IsDir())) || (err != nil && (t.ignore.Ignored(relPath, false) || t.ignore.Ignored(relPath, true))) {
+		return nil
+	}
+
+	// Special files are never opened, only FIFOs may be recreated on the peer
+	if err == nil && !isLink && IsSpecial(fi) {
+		if fi.Mode()&os.ModeNamedPipe != 0 && t.Specials == SPECIALS_METADATA {
+			if e.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 {
+				return t.handleEventFifo(fullPath, relPath)
+			}
+			return nil
+		}
+
+		log.Printf("[Remote %v:%v] Skipping special file %s", t.IP, t.Port, relPath)
+		return nil
+	}
+
 	// Handle events
+	// Created or modified symlink
+	if isLink && (e.Op&fsnotify.Write == fsnotify.Write || e.Op&fsnotify.Create == fsnotify.Create) {
+		return t.handleEventSymlink(fullPath, relPath)
+	}
+
 	// Created directory
-	if fi, err := os.Stat(fullPath); err == nil && fi.IsDir() && e.Op&fsnotify.Create == fsnotify.Create {
-		return t.handleEventCreateDir(fullPath, relPath, watcher)
+	// Any other change of a directory, such as its permissions or modification time, is sent as a create-directory request as well
+	if err == nil && fi.IsDir() && e.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+		return t.handleEventCreateDir(fullPath, relPath)
 	}
 
 	// Deleted file (rename behaves as a delete+create)
 	if e.Op&fsnotify.Remove == fsnotify.Remove || e.Op&fsnotify.Rename == fsnotify.Rename {
-		return t.handleEventDelete(fullPath, relPath, watcher)
+		return t.handleEventDelete(fullPath, relPath)
 	}
 
-	// Modified or created file
-	if e.Op&fsnotify.Write == fsnotify.Write || e.Op&fsnotify.Create == fsnotify.Create {
-		return t.handleEventUpdate(fullPath, relPath, watcher)
+	// Modified or created file, or changed permissions
+	if e.Op&fsnotify.Write == fsnotify.Write || e.Op&fsnotify.Create == fsnotify.Create || e.Op&fsnotify.Chmod == fsnotify.Chmod {
+		return t.handleEventUpdate(fullPath, relPath)
 	}
 
 	return nil
 }
 
-func (t *Tunnel) handleEventCreateDir(fullPath string, relPath string, watcher *fsnotify.Watcher) error {
+// Check if a path is selected to be sent to the peer by the include and exclude lists
+func (t *Tunnel) isSelected(relPath string) bool {
+	if len(t.Include) > 0 {
+		included := false
+		for _, pattern := range t.Include {
+			if matchPathPattern(pattern, relPath) {
+				included = true
+				break
+			}
+		}
+
+		if !included {
+			return false
+		}
+	}
+
+	for _, pattern := range t.Exclude {
+		if matchPathPattern(pattern, relPath) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the mode bits to send for a file or directory
+func (t *Tunnel) fileMode(fi os.FileInfo) uint32 {
+	if t.IgnorePerms {
+		return 0
+	}
+	return uint32(fi.Mode() & MODE_MASK)
+}
+
+// Get the metadata to send for a file or directory
+// Metadata that cannot be read is logged and not sent
+func (t *Tunnel) readMetadata(fullPath string) *FileMetadata {
+	meta, err := ReadMetadata(fullPath, &t.Metadata)
+	if err != nil {
+		log.Printf("[%v:%v] Unable to read metadata of %s: %s", t.IP, t.Port, fullPath, err)
+		return nil
+	}
+	return meta
+}
+
+func (t *Tunnel) handleEventCreateDir(fullPath string, relPath string) error {
 	log.Printf("[Remote %v:%v] Initiated create-directory for %s", t.IP, t.Port, relPath)
-	delete(__deleteTimes, relPath)
+	clearDeleteTime(t.FolderID, relPath)
 
 	fi, err := os.Stat(fullPath)
 	if err != nil {
@@ -302,36 +771,45 @@ func (t *Tunnel) handleEventCreateDir(fullPath string, relPath string, watcher *
 	}
 
 	// Do the create-directory request
-	watcher.Add(fullPath)
-	req := &FileInfoReq{
-		ReqType: REQ_TYPE_CREATE_DIR,
-		RelPath: relPath,
-		ModTime: fi.ModTime().UnixNano(),
+	if !t.isSelected(relPath) {
+		return nil
 	}
 
-	// Send request metadata
-	data, err := json.Marshal(req)
-	if err != nil {
-		return err
+	req := &FileInfoReq{
+		ReqType:  REQ_TYPE_CREATE_DIR,
+		FolderID: t.FolderID,
+		RelPath:  relPath,
+		ModTime:  fi.ModTime().UnixNano(),
+		Mode:     t.fileMode(fi),
+		Meta:     t.readMetadata(fullPath),
 	}
 
-	if err = t.encConn.WriteEncryptedFull(data); err != nil {
+	// Send request metadata
+	if resp, err := t.request(req); err != nil {
 		return err
+	} else if t.refused(resp, relPath) {
+		return nil
 	}
 
-	// No need to follow-up on create requests
 	log.Printf("[Remote %v:%v] Now synchronizing created directory %s", t.IP, t.Port, fullPath)
 	return nil
 }
 
-func (t *Tunnel) handleEventUpdate(fullPath string, relPath string, watcher *fsnotify.Watcher) error {
+func (t *Tunnel) handleEventUpdate(fullPath string, relPath string) error {
+	if !t.isSelected(relPath) {
+		return nil
+	}
+
 	log.Printf("[Remote %v:%v] Initiated update for %s", t.IP, t.Port, relPath)
-	delete(__deleteTimes, relPath)
+	clearDeleteTime(t.FolderID, relPath)
 
 	// Open file
 	f, err := os.OpenFile(fullPath, os.O_RDONLY, 0666)
-	if err != nil {
+	if err != nil && os.IsNotExist(err) {
+		// Removed since the event, the delete follows
 		return nil
+	} else if err != nil {
+		return err
 	}
 	lf := lfile.New(f)
 	defer func() {
@@ -357,73 +835,181 @@ func (t *Tunnel) handleEventUpdate(fullPath string, relPath string, watcher *fsn
 
 	// Create request metadata
 	req := &FileInfoReq{
-		ReqType: REQ_TYPE_UPDATE,
-		RelPath: relPath,
-		ModTime: modTime.UnixNano(),
+		ReqType:  REQ_TYPE_UPDATE,
+		FolderID: t.FolderID,
+		RelPath:  relPath,
+		ModTime:  modTime.UnixNano(),
+		Size:     stat.Size(),
+		Mode:     t.fileMode(stat),
+		Meta:     t.readMetadata(fullPath),
 	}
 
-	// Send request metadata
-	data, err := json.Marshal(req)
+	// Send request metadata and get response
+	resp, err := t.request(req)
 	if err != nil {
 		return err
 	}
 
-	if err = t.encConn.WriteEncryptedFull(data); err != nil {
-		return err
+	// Check response
+	if t.refused(resp, relPath) {
+		return nil
+	} else if resp.SendFile {
+		// Server requesting file
+		// Exactly the announced size is sent, even if the file grows or shrinks in the meantime
+		// The contents are hashed as they are sent, so that the peer can verify what it stored
+		log.Printf("[%v:%v] Transferring file %s", t.IP, t.Port, relPath)
+		h := sha256.New()
+		err = t.encConn.WriteEncryptedStream(io.TeeReader(lf, h), uint64(stat.Size()))
+		if _, ok := err.(sourceError); err != nil && !ok {
+			return fatalError{err}
+		}
+
+		// Tell the peer to discard the file if it changed while it was sent
+		trailer := &TransferTrailer{
+			Valid: err == nil && unchanged(f, stat),
+			Hash:  h.Sum(nil),
+		}
+
+		data, err := json.Marshal(trailer)
+		if err != nil {
+			return err
+		}
+
+		if err = t.encConn.WriteEncryptedFull(data); err != nil {
+			return fatalError{err}
+		}
+
+		// The peer answers again once the file is stored
+		if resp, err = t.readResponse(); err != nil {
+			return err
+		} else if t.refused(resp, relPath) {
+			return nil
+		}
+
+		if !trailer.Valid {
+			return fmt.Errorf("%s changed while it was sent", relPath)
+		}
+		log.Printf("[%v:%v] Transfer complete for %s", t.IP, t.Port, relPath)
+	} else {
+		log.Printf("[%v:%v] No update needed for %s", t.IP, t.Port, relPath)
 	}
 
-	// Get response
-	respData, err := t.encConn.ReadEncryptedFull()
+	return nil
+}
+
+// Log a request the peer refused, which is not retried as it would be refused again
+func (t *Tunnel) refused(resp *FileInfoResp, relPath string) bool {
+	if resp.Refused {
+		log.Printf("[%v:%v] Peer refused %s: %s", t.IP, t.Port, relPath, resp.Reason)
+	}
+	return resp.Refused
+}
+
+// Check that an open file still has the size and mod time it had before it was sent
+func unchanged(f *os.File, before os.FileInfo) bool {
+	after, err := f.Stat()
+	return err == nil && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime())
+}
+
+func (t *Tunnel) handleEventSymlink(fullPath string, relPath string) error {
+	if !t.isSelected(relPath) {
+		return nil
+	}
+
+	log.Printf("[Remote %v:%v] Initiated symlink for %s", t.IP, t.Port, relPath)
+	clearDeleteTime(t.FolderID, relPath)
+
+	fi, err := os.Lstat(fullPath)
 	if err != nil {
 		return err
 	}
 
-	var resp FileInfoResp
-	err = json.Unmarshal(respData, &resp)
+	target, err := os.Readlink(fullPath)
 	if err != nil {
 		return err
 	}
 
-	// Check response
-	if resp.SendFile {
-		// Server requesting file
-		log.Printf("[%v:%v] Transferring file %s", t.IP, t.Port, relPath)
-		if err = t.encConn.WriteEncryptedStream(lf, uint64(stat.Size())); err != nil {
-			return err
-		}
-		log.Printf("[%v:%v] Transfer complete for %s", t.IP, t.Port, relPath)
-	} else {
-		log.Printf("[%v:%v] No update needed for %s", t.IP, t.Port, relPath)
+	req := &FileInfoReq{
+		ReqType:    REQ_TYPE_SYMLINK,
+		FolderID:   t.FolderID,
+		RelPath:    relPath,
+		ModTime:    fi.ModTime().UnixNano(),
+		LinkTarget: filepath.ToSlash(target),
 	}
 
+	if resp, err := t.request(req); err != nil {
+		return err
+	} else if t.refused(resp, relPath) {
+		return nil
+	}
+
+	log.Printf("[Remote %v:%v] Symlink completed for %s -> %s", t.IP, t.Port, relPath, target)
 	return nil
 }
 
-func (t *Tunnel) handleEventDelete(fullPath string, relPath string, watcher *fsnotify.Watcher) error {
-	log.Printf("[Remote %v:%v] Initiated delete for %s", t.IP, t.Port, relPath)
+func (t *Tunnel) handleEventFifo(fullPath string, relPath string) error {
+	if !t.isSelected(relPath) {
+		return nil
+	}
 
-	var delTime int64
-	if _, ok := __deleteTimes[relPath]; ok {
-		delTime = __deleteTimes[relPath]
-	} else {
-		delTime = time.Now().UnixNano()
-		__deleteTimes[relPath] = delTime
+	log.Printf("[Remote %v:%v] Initiated FIFO for %s", t.IP, t.Port, relPath)
+	clearDeleteTime(t.FolderID, relPath)
+
+	fi, err := os.Lstat(fullPath)
+	if err != nil {
+		return err
 	}
-	watcher.Remove(fullPath)
 
+	// Only the entry is sent, never any data
 	req := &FileInfoReq{
-		ReqType: REQ_TYPE_DELETE,
-		RelPath: relPath,
-		DelTime: delTime,
+		ReqType:  REQ_TYPE_FIFO,
+		FolderID: t.FolderID,
+		RelPath:  relPath,
+		ModTime:  fi.ModTime().UnixNano(),
+		Mode:     t.fileMode(fi),
 	}
 
-	data, err := json.Marshal(req)
-	if err != nil {
+	if resp, err := t.request(req); err != nil {
 		return err
+	} else if t.refused(resp, relPath) {
+		return nil
 	}
 
-	if err = t.encConn.WriteEncryptedFull(data); err != nil {
+	log.Printf("[Remote %v:%v] FIFO completed for %s", t.IP, t.Port, relPath)
+	return nil
+}
+
+func (t *Tunnel) handleEventDelete(fullPath string, relPath string) error {
+	delTime, ok := getDeleteTime(t.FolderID, relPath)
+	if !ok {
+		if t.DeleteGuard.Held(relPath) {
+			return errDeleteHeld
+		}
+
+		delTime = time.Now().UnixNano()
+		if !t.DeleteGuard.Allow(relPath, delTime) {
+			log.Printf("[Remote %v:%v] Holding back delete for %s", t.IP, t.Port, relPath)
+			return errDeleteHeld
+		}
+		setDeleteTime(t.FolderID, relPath, delTime)
+	}
+
+	if !t.isSelected(relPath) {
+		return nil
+	}
+
+	log.Printf("[Remote %v:%v] Initiated delete for %s", t.IP, t.Port, relPath)
+	req := &FileInfoReq{
+		ReqType:  REQ_TYPE_DELETE,
+		FolderID: t.FolderID,
+		RelPath:  relPath,
+		DelTime:  delTime,
+	}
+
+	if resp, err := t.request(req); err != nil {
 		return err
+	} else if t.refused(resp, relPath) {
+		return nil
 	}
 
 	log.Printf("[Remote %v:%v] Delete completed for %s", t.IP, t.Port, relPath)
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directory within each folder where old versions of files are kept
+const VERSIONS_DIR = INTERNAL_PREFIX + string(os.PathSeparator) + "versions"
+
+// Format of the timestamp appended to versioned files
+const VERSION_TIME_FORMAT = "20060102-150405"
+
+// VersioningEntry.Type
+const (
+	VERSIONING_TRASHCAN  = "trashcan"  // Keep the last version of each file
+	VERSIONING_KEEP      = "keep"      // Keep the last N versions of each file
+	VERSIONING_STAGGERED = "staggered" // Keep fewer versions the older they get
+)
+
+type VersioningEntry struct {
+	Type         string `json:"type"`
+	Keep         int    `json:"keep"`         // keep: Number of versions to keep per file
+	CleanoutDays int    `json:"cleanoutDays"` // trashcan: Remove versions older than this many days; 0 keeps them forever
+	MaxAgeDays   int    `json:"maxAgeDays"`   // staggered: Remove versions older than this many days; 0 keeps them forever
+}
+
+// Versioner keeps old copies of files in a folder when they are replaced or deleted
+type Versioner struct {
+	Root    string
+	Config  VersioningEntry
+	NoPrune bool // Never remove versions, for append-only peers
+}
+
+type Version struct {
+	RelPath string    // Path of the original file relative to the folder root
+	Time    time.Time // When the file was replaced or deleted
+	Path    string    // Fully qualified path of the kept copy
+}
+
+// Create a versioner for a folder, or nil if versioning is disabled
+func NewVersioner(root string, config *VersioningEntry) *Versioner {
+	if config == nil || config.Type == "" {
+		return nil
+	}
+
+	return &Versioner{
+		Root:   root,
+		Config: *config,
+	}
+}
+
+// Keep a copy of a file that is about to be replaced
+// The file itself is left in place so that it can be replaced atomically
+func (v *Versioner) Keep(relPath string) error {
+	return v.archive(relPath, false)
+}
+
+// Move a file that is about to be deleted into the versions directory
+func (v *Versioner) Move(relPath string) error {
+	return v.archive(relPath, true)
+}
+
+func (v *Versioner) archive(relPath string, move bool) error {
+	source := v.Root + relPath
+	now := time.Now()
+	target := v.versionPath(relPath, now)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	// Replaced more than once within the same second, use the next free timestamp
+	for {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			break
+		}
+		now = now.Add(time.Second)
+		target = v.versionPath(relPath, now)
+	}
+
+	var err error
+	if move {
+		err = os.Rename(source, target)
+	} else if err = os.Link(source, target); err != nil {
+		// Hard links are not supported everywhere, fall back to copying
+		err = copyFile(source, target)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Kept version %s of %s", now.Format(VERSION_TIME_FORMAT), relPath)
+	if v.NoPrune {
+		return nil
+	}
+	return v.prune(relPath, now)
+}
+
+// List the kept versions of all files beneath a path relative to the folder root, oldest first
+func (v *Versioner) List(relPath string) ([]Version, error) {
+	versions := []Version{}
+	dir := v.Root + VERSIONS_DIR + string(os.PathSeparator)
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		version, ok := parseVersion(strings.TrimPrefix(path, dir))
+		if !ok {
+			return nil
+		}
+		version.Path = path
+
+		if relPath == "" || version.RelPath == relPath || strings.HasPrefix(version.RelPath, relPath+string(os.PathSeparator)) {
+			versions = append(versions, version)
+		}
+		return nil
+	})
+
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].RelPath != versions[j].RelPath {
+			return versions[i].RelPath < versions[j].RelPath
+		}
+		return versions[i].Time.Before(versions[j].Time)
+	})
+
+	return versions, err
+}
+
+// Restore a kept version of a file
+// The current file, if any, is kept as a new version
+func (v *Versioner) Restore(relPath string, timestamp string) error {
+	t, err := time.ParseInLocation(VERSION_TIME_FORMAT, timestamp, time.Local)
+	if err != nil {
+		return err
+	}
+
+	source := v.versionPath(relPath, t)
+	if _, err = os.Stat(source); err != nil {
+		return err
+	}
+
+	target := v.Root + relPath
+	if err = os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+
+	// Restore through a staging file so the file is replaced atomically
+	// The version is copied first as keeping the current file may prune it
+	staging, err := CreateStagingFile(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	staging.Close()
+	defer os.Remove(staging.Name())
+
+	if err = copyFile(source, staging.Name()); err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(target); err == nil {
+		if fi.IsDir() {
+			return fmt.Errorf("%s is a directory", relPath)
+		}
+
+		if err = v.Keep(relPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(staging.Name(), target)
+}
+
+// Remove versions of a file that are no longer needed
+func (v *Versioner) prune(relPath string, now time.Time) error {
+	versions, err := v.List(relPath)
+	if err != nil {
+		return err
+	}
+
+	// Only versions of this exact file, newest first
+	own := []Version{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].RelPath == relPath {
+			own = append(own, versions[i])
+		}
+	}
+
+	remove := []Version{}
+	switch v.Config.Type {
+	case VERSIONING_TRASHCAN:
+		for i, version := range own {
+			if i > 0 || (v.Config.CleanoutDays > 0 && now.Sub(version.Time) > time.Duration(v.Config.CleanoutDays)*24*time.Hour) {
+				remove = append(remove, version)
+			}
+		}
+	case VERSIONING_KEEP:
+		keep := v.Config.Keep
+		if keep <= 0 {
+			keep = 5
+		}
+
+		if len(own) > keep {
+			remove = own[keep:]
+		}
+	case VERSIONING_STAGGERED:
+		remove = staggeredPrune(own, now, v.Config.MaxAgeDays)
+	}
+
+	for _, version := range remove {
+		log.Printf("Removing version %s of %s", version.Time.Format(VERSION_TIME_FORMAT), version.RelPath)
+		err = os.Remove(version.Path)
+		InvalidateUsage(version.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Select versions to remove so that one version is kept per interval:
+// every 30 seconds for the first hour, every hour for the first day, every day for the first 30 days and every week after that
+// Versions must be sorted newest first
+func staggeredPrune(versions []Version, now time.Time, maxAgeDays int) []Version {
+	remove := []Version{}
+	var lastKept time.Time
+
+	for i, version := range versions {
+		age := now.Sub(version.Time)
+		if maxAgeDays > 0 && age > time.Duration(maxAgeDays)*24*time.Hour {
+			remove = append(remove, version)
+			continue
+		}
+
+		var interval time.Duration
+		switch {
+		case age < time.Hour:
+			interval = 30 * time.Second
+		case age < 24*time.Hour:
+			interval = time.Hour
+		case age < 30*24*time.Hour:
+			interval = 24 * time.Hour
+		default:
+			interval = 7 * 24 * time.Hour
+		}
+
+		if i > 0 && lastKept.Sub(version.Time) < interval {
+			remove = append(remove, version)
+			continue
+		}
+		lastKept = version.Time
+	}
+
+	return remove
+}
+
+func (v *Versioner) versionPath(relPath string, t time.Time) string {
+	return v.Root + VERSIONS_DIR + string(os.PathSeparator) + relPath + "~" + t.Format(VERSION_TIME_FORMAT)
+}
+
+// Split the path of a kept version relative to the versions directory into the original path and time
+func parseVersion(path string) (Version, bool) {
+	i := strings.LastIndex(path, "~")
+	if i < 0 {
+		return Version{}, false
+	}
+
+	t, err := time.ParseInLocation(VERSION_TIME_FORMAT, path[i+1:], time.Local)
+	if err != nil {
+		return Version{}, false
+	}
+
+	return Version{
+		RelPath: path[:i],
+		Time:    t,
+	}, true
+}
+
+// Copy a file, keeping its permissions and mod-time
+func copyFile(source string, target string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return errors.New("Only regular files can be copied")
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode()&MODE_MASK)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaggeredPrune(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local)
+	ages := []time.Duration{
+		10 * time.Second,
+		20 * time.Second, // Within 30 seconds of the newer version
+		50 * time.Second,
+		2 * time.Hour,
+		150 * time.Minute, // Within an hour of the newer version
+		4 * time.Hour,
+		3 * 24 * time.Hour,
+		3*24*time.Hour + 12*time.Hour, // Within a day of the newer version
+		40 * 24 * time.Hour,           // Older than the maximum age
+	}
+
+	versions := []Version{}
+	for _, age := range ages {
+		versions = append(versions, Version{RelPath: "a", Time: now.Add(-age)})
+	}
+
+	want := []Version{versions[1], versions[4], versions[7], versions[8]}
+	if got := staggeredPrune(versions, now, 35); !reflect.DeepEqual(got, want) {
+		t.Errorf("staggeredPrune() = %v, want %v", got, want)
+	}
+
+	// Without a maximum age, old versions are kept weekly
+	want = []Version{versions[1], versions[4], versions[7]}
+	if got := staggeredPrune(versions, now, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("staggeredPrune() without maximum age = %v, want %v", got, want)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v := &Versioner{Root: "/root/"}
+	when := time.Date(2020, 6, 1, 12, 30, 15, 0, time.Local)
+	relPath := filepath.Join("dir", "file~name.txt")
+
+	path := strings.TrimPrefix(v.versionPath(relPath, when), v.Root+VERSIONS_DIR+string(filepath.Separator))
+	version, ok := parseVersion(path)
+	if !ok || version.RelPath != relPath || !version.Time.Equal(when) {
+		t.Errorf("parseVersion(%q) = %+v, %v; want %s at %s", path, version, ok, relPath, when)
+	}
+
+	if _, ok = parseVersion("file.txt"); ok {
+		t.Errorf("parseVersion() accepted a path without a time")
+	} else if _, ok = parseVersion("file.txt~yesterday"); ok {
+		t.Errorf("parseVersion() accepted an invalid time")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How often the journal is persisted
+const JOURNAL_FLUSH_INTERVAL = 5 * time.Second
+
+// How often changes waiting for a path to settle are checked
+const DEBOUNCE_CHECK_INTERVAL = 100 * time.Millisecond
+
+// A change that is recorded once the path settles
+type pendingChange struct {
+	Op          fsnotify.Op
+	Last        time.Time // Time of the last event
+	Size        int64
+	ModTime     time.Time
+	StableSince time.Time // Since when size and modification time are unchanged; zero until checked
+}
+
+// FolderWatcher watches a folder for as long as the program runs, recording every change in the folder's journal
+// Changes are recorded whether or not any peer is connected, and the peers of the folder share the watcher and its scans
+type FolderWatcher struct {
+	Root        string
+	Symlinks    string
+	Journal     *Journal
+	Debounce    time.Duration // Events of a path are merged until none arrived for this long
+	StableDelay time.Duration // Files are only recorded once their size and modification time stayed the same for this long
+	Rescan      time.Duration // How often the folder is scanned for changes that were missed by the watcher
+	Type        string        // One of "auto", "notify" or "poll"
+	Poll        time.Duration // How often directories are listed when polling
+	DeleteGuard *DeleteGuard  // Told the number of items found by each scan
+
+	source  EventSource
+	noSpace bool // Adding a watch failed as the limit of watches was reached
+	pending map[string]*pendingChange
+	mu      sync.Mutex
+	ignore  *IgnoreMatcher
+	items   *ScanResult // Result of the last scan
+	itemsAt int64       // Journal sequence number before the last scan
+}
+
+// Start watching the folder
+// Changes made since the journal was last persisted are recorded first
+func (w *FolderWatcher) Start() error {
+	w.Root = strings.TrimSuffix(w.Root, string(os.PathSeparator)) + string(os.PathSeparator)
+	w.ignore = ignoreMatcher(w.Root)
+	w.pending = make(map[string]*pendingChange)
+
+	// Network and FUSE filesystems do not report changes made elsewhere
+	var err error
+	notify := w.Type == WATCHER_NOTIFY
+	if w.Type == WATCHER_AUTO {
+		if fsType, ok := UnwatchableFilesystem(w.Root); ok {
+			log.Printf("Filesystem of %s (%s) does not support change notifications, polling every %s", w.Root, fsType, w.Poll)
+		} else {
+			notify = true
+		}
+	}
+
+	if notify {
+		var source *notifySource
+		if source, err = newNotifySource(); err == nil {
+			err = w.open(source)
+		}
+
+		// Fall back to polling once the limits of the operating system are reached
+		if (err == syscall.ENOSPC || err == syscall.EMFILE) && w.Type == WATCHER_AUTO {
+			log.Printf("Unable to watch %s, polling every %s instead: %s", w.Root, w.Poll, err)
+			notify = false
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !notify {
+		if err = w.open(newPollSource(w.Poll)); err != nil {
+			return err
+		}
+	}
+
+	go w.run()
+	return nil
+}
+
+// Watch the folder with an event source and record everything that changed since the journal was last persisted
+func (w *FolderWatcher) open(source EventSource) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.source = source
+	w.noSpace = false
+	err := source.Add(w.Root)
+	if err == nil {
+		err = w.rescan()
+	}
+
+	if err == nil && w.noSpace {
+		err = syscall.ENOSPC
+	}
+
+	if err != nil {
+		source.Close()
+	}
+	return err
+}
+
+// Get the items of the folder and the journal sequence number they reflect
+// The last scan is reused as long as the journal holds every change since
+func (w *FolderWatcher) Snapshot() (*ScanResult, int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.Journal.Trusted(w.itemsAt) {
+		if err := w.rescan(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return w.items, w.itemsAt, nil
+}
+
+// Rescan the folder, logging failures
+func (w *FolderWatcher) rescanLogged() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	log.Printf("Rescanning %s", w.Root)
+	if err := w.rescan(); err != nil {
+		log.Printf("Unable to rescan %s: %s", w.Root, err)
+	}
+}
+
+// Watch all directories and record everything that changed without an event
+// The caller must hold the lock
+func (w *FolderWatcher) rescan() error {
+	seq := w.Journal.Seq()
+	w.ignore.Reset()
+	items, err := ListItems(w.Root, "", w.ignore, w.Symlinks)
+	if err != nil {
+		return err
+	}
+	w.items = items
+	w.itemsAt = seq
+	w.DeleteGuard.SetKnownItems(len(items.Files) + len(items.Dirs) + len(items.Links) + len(items.Specials))
+
+	for _, d := range items.Dirs {
+		if err = w.source.Add(w.Root + d); err == syscall.ENOSPC {
+			log.Printf("Unable to watch directory %s, the limit of watches was reached; consider polling the folder: %s", w.Root+d, err)
+			w.noSpace = true
+		} else if err != nil {
+			log.Printf("Unable to watch directory %s: %s", w.Root+d, err)
+		}
+	}
+
+	paths := append(append(append(append([]string{}, items.Dirs...), items.Files...), items.Links...), items.Specials...)
+	return w.Journal.Reconcile(paths)
+}
+
+func (w *FolderWatcher) run() {
+	defer w.source.Close()
+
+	ticker := time.NewTicker(JOURNAL_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	settle := time.NewTicker(DEBOUNCE_CHECK_INTERVAL)
+	defer settle.Stop()
+
+	rescan := time.NewTicker(w.Rescan)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case <-settle.C:
+			w.recordSettled()
+		case <-rescan.C:
+			w.rescanLogged()
+		case <-ticker.C:
+			if err := w.Journal.Flush(); err != nil {
+				log.Printf("Unable to persist journal of %s: %s", w.Root, err)
+			}
+		case e, ok := <-w.source.Events():
+			if !ok {
+				log.Printf("Watcher for %s closed", w.Root)
+				return
+			}
+			w.handleEvent(e)
+		case err, ok := <-w.source.Errors():
+			if !ok {
+				log.Printf("Watcher for %s closed", w.Root)
+				return
+			}
+			log.Printf("Watcher error for %s: %s", w.Root, err)
+
+			// Events were dropped, so peers synchronize everything rather than trusting the journal, and the rescan finds the changes they were about
+			if err == fsnotify.ErrEventOverflow {
+				w.Journal.Untrust()
+				w.rescanLogged()
+			}
+		}
+	}
+}
+
+func (w *FolderWatcher) handleEvent(e fsnotify.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	relPath := strings.TrimPrefix(e.Name, w.Root)
+	if relPath == e.Name || relPath == "" || filepath.Clean(relPath) != relPath {
+		return
+	}
+
+	// Ignored paths are never recorded
+	// Paths that no longer exist are ignored if they would be ignored as either a file or a directory
+	fi, err := os.Stat(e.Name)
+	if (err == nil && w.ignore.Ignored(relPath, fi.IsDir())) || (err != nil && (w.ignore.Ignored(relPath, false) || w.ignore.Ignored(relPath, true))) {
+		return
+	}
+
+	// Watch new directories and stop watching removed ones
+	if err == nil && fi.IsDir() && e.Op&fsnotify.Create == fsnotify.Create {
+		if lfi, err := os.Lstat(e.Name); err == nil && (lfi.IsDir() || w.Symlinks == SYMLINKS_FOLLOW) {
+			w.source.Add(e.Name)
+			w.addContents(relPath)
+		}
+	} else if e.Op&fsnotify.Remove == fsnotify.Remove || e.Op&fsnotify.Rename == fsnotify.Rename {
+		w.source.Remove(e.Name)
+	}
+
+	w.addPending(relPath, e.Op)
+
+	// Paths may no longer be ignored, or be ignored now
+	if filepath.Base(relPath) == IGNORE_FILE {
+		log.Printf("Ignore file %s changed, rescanning %s", e.Name, w.Root)
+		if err := w.rescan(); err != nil {
+			log.Printf("Unable to rescan %s: %s", w.Root, err)
+		}
+	}
+}
+
+// Merge a change into the changes waiting for their path to settle, as bursts of events are recorded as one change
+// The caller must hold the lock
+func (w *FolderWatcher) addPending(relPath string, op fsnotify.Op) {
+	if p, ok := w.pending[relPath]; ok {
+		p.Op = mergeOps(p.Op, op)
+		p.Last = time.Now()
+		p.StableSince = time.Time{}
+	} else {
+		w.pending[relPath] = &pendingChange{
+			Op:   op,
+			Last: time.Now(),
+		}
+	}
+}
+
+// Watch the directories within a new directory and record everything in it
+// Whatever a directory contains before it is watched causes no events, for example after it was copied or moved into the folder
+// The caller must hold the lock
+func (w *FolderWatcher) addContents(relPath string) {
+	dir := relPath + string(os.PathSeparator)
+	items, err := ListItems(w.Root+dir, dir, w.ignore, w.Symlinks)
+	if err != nil {
+		log.Printf("Unable to list new directory %s: %s", w.Root+relPath, err)
+		return
+	}
+
+	for _, d := range items.Dirs {
+		if err = w.source.Add(w.Root + d); err != nil {
+			log.Printf("Unable to watch directory %s: %s", w.Root+d, err)
+		}
+	}
+
+	for _, list := range [][]string{items.Dirs, items.Files, items.Links, items.Specials} {
+		for _, p := range list {
+			w.addPending(p, fsnotify.Create)
+		}
+	}
+}
+
+// Record the changes of paths that received no events for the debounce delay and whose size and modification time stopped changing
+func (w *FolderWatcher) recordSettled() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for relPath, p := range w.pending {
+		if now.Sub(p.Last) < w.Debounce {
+			continue
+		}
+
+		// Only regular files are written over time
+		fi, err := os.Lstat(w.Root + relPath)
+		if err == nil && fi.Mode().IsRegular() {
+			if p.StableSince.IsZero() || fi.Size() != p.Size || !fi.ModTime().Equal(p.ModTime) {
+				p.Size = fi.Size()
+				p.ModTime = fi.ModTime()
+				p.StableSince = now
+			}
+
+			if now.Sub(p.StableSince) < w.StableDelay {
+				continue
+			}
+		}
+
+		delete(w.pending, relPath)
+		if err := w.Journal.Record(relPath, p.Op); err != nil {
+			log.Printf("Unable to record change of %s in journal: %s", w.Root+relPath, err)
+		}
+	}
+}
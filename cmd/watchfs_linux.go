@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// Filesystems that do not send change notifications for changes made by other machines
+var __unwatchableFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+}
+
+// Get the type of the filesystem containing a path if it is known not to support change notifications
+func UnwatchableFilesystem(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+
+	name, ok := __unwatchableFilesystems[uint32(st.Type)]
+	return name, ok
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Get the type of the filesystem containing a path if it is known not to support change notifications
+// Only detected on Linux
+func UnwatchableFilesystem(path string) (string, bool) {
+	return "", false
+}